@@ -0,0 +1,102 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"proxy/config"
+	"proxy/utils"
+)
+
+//客户端本地管理接口
+//
+//GET  /api/status  所有代理的状态
+//POST /api/reload  重新加载配置文件中的代理
+type AdminServer struct {
+	client *Client
+	mux    *http.ServeMux
+}
+
+func NewAdminServer(client *Client) (as *AdminServer) {
+	as = &AdminServer{
+		client: client,
+		mux:    http.NewServeMux(),
+	}
+	as.mux.HandleFunc("/api/status", as.handleStatus)
+	as.mux.HandleFunc("/api/reload", as.handleReload)
+	return
+}
+
+func (as *AdminServer) Run(l net.Listener) {
+	server := &http.Server{
+		Handler:     as,
+		ReadTimeout: ReadTimeout,
+	}
+	if err := server.Serve(l); err != nil {
+		log.Warn("admin server exit:", err)
+	}
+}
+
+func (as *AdminServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	conf := as.client.config
+	user, pwd, ok := req.BasicAuth()
+	if !ok || conf.AdminUser == "" || !utils.SecureEqual(user, conf.AdminUser) || !utils.SecureEqual(pwd, conf.AdminPwd) {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="proxy client admin"`)
+		utils.WriteError(rw, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	as.mux.ServeHTTP(rw, req)
+}
+
+//管理接口可以重新加载代理配置，不允许在没有认证的情况下开启
+func checkAdminAuth(conf *config.ClientConfig) error {
+	if conf.AdminUser == "" || conf.AdminPwd == "" {
+		return fmt.Errorf("admin_addr is set, but admin_user/admin_pwd is not configured")
+	}
+	return nil
+}
+
+type ClientStatus struct {
+	ClientId  string        `json:"client_id"`
+	Connected bool          `json:"connected"`
+	LastPong  time.Time     `json:"last_pong"`
+	Proxies   []ProxyStatus `json:"proxies"`
+}
+
+func (as *AdminServer) handleStatus(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		utils.WriteError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	c := as.client
+	c.mu.RLock()
+	clientId := c.clientId
+	c.mu.RUnlock()
+
+	status := ClientStatus{
+		ClientId:  clientId,
+		Connected: c.isConnected(),
+		LastPong:  c.getLastPong(),
+		Proxies:   c.manager.GetStatus(),
+	}
+
+	utils.WriteJson(rw, http.StatusOK, status)
+}
+
+func (as *AdminServer) handleReload(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		utils.WriteError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	result, err := as.client.Reload()
+	if err != nil {
+		utils.WriteError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	utils.WriteJson(rw, http.StatusOK, result)
+}
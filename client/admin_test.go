@@ -0,0 +1,49 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"proxy/config"
+)
+
+func TestNewClientRequiresAdminAuth(t *testing.T) {
+	for _, conf := range []*config.ClientConfig{
+		{AdminAddr: "127.0.0.1:0"},
+		{AdminAddr: "127.0.0.1:0", AdminUser: "admin"},
+		{AdminAddr: "127.0.0.1:0", AdminPwd: "admin"},
+	} {
+		if _, err := NewClient(conf); err == nil {
+			t.Fatalf("admin server started without credentials: %+v", conf)
+		}
+	}
+}
+
+func TestAdminServerAuth(t *testing.T) {
+	c := &Client{config: &config.ClientConfig{AdminUser: "admin", AdminPwd: "secret"}}
+	as := NewAdminServer(c)
+
+	cases := []struct {
+		user, pwd string
+		auth      bool
+		code      int
+	}{
+		{auth: false, code: http.StatusUnauthorized},
+		{user: "admin", pwd: "wrong", auth: true, code: http.StatusUnauthorized},
+		{user: "", pwd: "", auth: true, code: http.StatusUnauthorized},
+		//认证通过后由具体的接口处理，GET /api/reload 不被允许
+		{user: "admin", pwd: "secret", auth: true, code: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/api/reload", nil)
+		if tc.auth {
+			req.SetBasicAuth(tc.user, tc.pwd)
+		}
+		rw := httptest.NewRecorder()
+		as.ServeHTTP(rw, req)
+		if rw.Code != tc.code {
+			t.Errorf("user %q pwd %q: code = %d, want %d", tc.user, tc.pwd, rw.Code, tc.code)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package client
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -15,75 +18,203 @@ import (
 
 const (
 	ReadTimeout time.Duration = 10 * time.Second
+
+	//断线重连的退避时间
+	ReconnectMinInterval time.Duration = 1 * time.Second
+	ReconnectMaxInterval time.Duration = 60 * time.Second
 )
 
 type Client struct {
-	conn    net.Conn
-	config  *config.ClientConfig
-	manager *Manager
+	conn      net.Conn
+	session   *utils.Session
+	tlsConfig *tls.Config
+	config    *config.ClientConfig
+	manager   *Manager
 
 	clientId string
 	Token    string
 
-	sendCh    chan (msg.Message)
-	receiveCh chan (msg.Message)
-	blocked   chan int
-	exit      bool
-	lastPong  time.Time
+	sendCh   chan (msg.Message)
+	exit     bool
+	exitCh   chan struct{}
+	lastPong time.Time
+
+	//控制连接断开时关闭，通知本次连接的所有goroutine退出
+	done chan struct{}
+	//等待StartWork的工作连接，控制连接断开时关闭
+	workConns map[net.Conn]struct{}
 
-	closed chan int
-	mu     sync.RWMutex
+	mu sync.RWMutex
 }
 
-func NewClient(conf *config.ClientConfig) (client *Client) {
+func NewClient(conf *config.ClientConfig) (client *Client, err error) {
 	client = &Client{
 		config:    conf,
 		sendCh:    make(chan msg.Message, 10),
-		receiveCh: make(chan msg.Message, 10),
-		blocked:   make(chan int),
-		closed:    make(chan int),
 		Token:     conf.Token,
 		exit:      false,
+		exitCh:    make(chan struct{}),
+		workConns: make(map[net.Conn]struct{}),
+	}
+
+	if conf.TlsEnable {
+		serverName := conf.TlsServerName
+		if serverName == "" {
+			serverName = conf.ServerIP
+		}
+		client.tlsConfig, err = utils.NewClientTLSConfig(conf.TlsCertFile, conf.TlsKeyFile, conf.TlsTrustedCaFile, serverName)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	client.manager = NewManager(client, conf.AllProxy, client.sendCh)
+	client.manager = NewManager(client, conf.AllProxy)
+
+	if conf.AdminAddr != "" {
+		if err = checkAdminAuth(conf); err != nil {
+			return nil, err
+		}
+		var l net.Listener
+		l, err = net.Listen("tcp", conf.AdminAddr)
+		if err != nil {
+			return nil, err
+		}
+		go NewAdminServer(client).Run(l)
+		log.Info("admin server listen on ", conf.AdminAddr)
+	}
 
 	return
 }
 
 func (c *Client) Run() {
 	for {
-		err := c.login()
-		if err != nil {
-			log.Error(err)
-			time.Sleep(10 * time.Second)
-		} else {
+		c.connect()
+		if c.isExit() {
 			break
 		}
 
+		c.worker()
+
+		c.manager.ResetProxies()
+		if c.isExit() {
+			break
+		}
+		log.Info("connection to server lost, reconnect")
 	}
-	go c.worker()
+	log.Info("client closed")
+}
 
-	c.manager.CheckProxy()
+func (c *Client) Close() {
+	c.mu.Lock()
+	if !c.exit {
+		c.exit = true
+		close(c.exitCh)
+	}
+	conn := c.conn
+	c.mu.Unlock()
 
-	<-c.closed
-	log.Info("client closed")
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+//重新读取配置文件并应用代理配置的变化，控制连接不会断开
+func (c *Client) Reload() (result ReloadResult, err error) {
+	if c.config.ConfigFile == "" {
+		return result, fmt.Errorf("no config file to reload")
+	}
+	conf, err := config.NewClientConfWithFile(c.config.ConfigFile)
+	if err != nil {
+		return result, err
+	}
+
+	result = c.manager.Reload(conf.AllProxy)
+	log.Info("reload proxies, added:", result.Added, " removed:", result.Removed, " changed:", result.Changed)
+
+	//未连接时不需要通知服务器，重新登录后会注册所有代理
+	if !c.isConnected() {
+		return result, nil
+	}
+
+	closed := append(append([]string{}, result.Removed...), result.Changed...)
+	for _, name := range closed {
+		m, err := msg.Pack(msg.TypeCloseProxy, msg.CloseProxy{ProxyName: name})
+		if err != nil {
+			return result, err
+		}
+		if !c.sendMsg(m) {
+			return result, nil
+		}
+	}
+	go c.manager.CheckProxy()
+	return result, nil
+}
+
+func (c *Client) isConnected() bool {
+	c.mu.RLock()
+	done := c.done
+	c.mu.RUnlock()
+
+	if done == nil {
+		return false
+	}
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *Client) isExit() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.exit
+}
+
+//登录服务器，失败时按指数退避加随机抖动重试，直到成功或客户端退出
+func (c *Client) connect() {
+	interval := ReconnectMinInterval
+	for !c.isExit() {
+		err := c.login()
+		if err == nil {
+			return
+		}
+		log.Error("connect to server failed:", err)
+
+		jitter := time.Duration(rand.Int63n(int64(interval)))
+		select {
+		case <-time.After(interval/2 + jitter):
+		case <-c.exitCh:
+			return
+		}
+
+		interval *= 2
+		if interval > ReconnectMaxInterval {
+			interval = ReconnectMaxInterval
+		}
+	}
 }
 
 func (c *Client) login() error {
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	c.mu.Lock()
+	if c.session != nil {
+		c.session.Close()
+		c.session = nil
+	}
+	c.mu.Unlock()
 
-	now := time.Now().Unix()
-	_, sign := utils.GetMD5([]byte(fmt.Sprintf("%s%d", c.config.Token, now)))
-	log.Debug(sign)
+	hostname, _ := os.Hostname()
 	loginMsg := msg.Login{
+		Hostname:      hostname,
 		User:          c.config.User,
-		Sign:          sign,
-		Timestamp:     now,
+		Timestamp:     time.Now().Unix(),
 		ClientId:      c.clientId,
 		ConnPoolCount: c.config.ConnPoolCount,
+		AuthMethod:    msg.AuthMethodHmac,
 	}
 
 	log.Debug(loginMsg)
@@ -95,80 +226,138 @@ func (c *Client) login() error {
 	log.Debug("connect server success")
 
 	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
-	err = msg.WriteMsg(msg.TypeLogin, loginMsg, conn)
+	loginResp, token, err := c.auth(conn, loginMsg)
 	if err != nil {
+		conn.Close()
 		return err
 	}
+	conn.SetReadDeadline(time.Time{})
+
+	log.Debug(loginResp)
+	c.mu.Lock()
+	c.clientId = loginResp.ClientId
+	c.conn = conn
+	c.Token = token
+	exit := c.exit
+	c.mu.Unlock()
+	c.manager.SetToken(token)
+
+	if exit {
+		conn.Close()
+		return fmt.Errorf("client is closed")
+	}
+	return nil
+}
+
+//登录成功后返回本次连接使用的密钥，服务器只保存token校验值时为由token、salt和随机数计算的会话密钥
+func (c *Client) auth(conn net.Conn, loginMsg msg.Login) (*msg.LoginResp, string, error) {
+	token := c.config.Token
+	err := msg.WriteMsg(msg.TypeLogin, loginMsg, conn)
+	if err != nil {
+		return nil, "", err
+	}
 
 	msg_type, m, err := msg.ReadMsg(conn)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+
+	//服务器返回随机数，使用token计算签名后继续等待登录结果
+	if msg_type == msg.TypeLoginChallenge {
+		challenge := m.(*msg.LoginChallenge)
+		signData := loginMsg.HmacSignData(challenge.Nonce)
+		loginAuth := msg.LoginAuth{}
+		if challenge.Salt != "" {
+			//服务器只保存校验值，发送登录证明，之后使用会话密钥
+			clientKey := utils.ClientTokenKey(utils.DeriveTokenKey(token, challenge.Salt))
+			loginAuth.Sign = utils.TokenProof(clientKey, utils.StoredTokenKey(clientKey), signData)
+			token = utils.SessionTokenKey(clientKey, challenge.Nonce)
+		} else {
+			loginAuth.Sign = utils.GetHmacSign([]byte(token), signData)
+		}
+		if err = msg.WriteMsg(msg.TypeLoginAuth, loginAuth, conn); err != nil {
+			return nil, "", err
+		}
+
+		msg_type, m, err = msg.ReadMsg(conn)
+		if err != nil {
+			return nil, "", err
+		}
 	}
+
 	if msg_type != msg.TypeLoginResp {
-		return fmt.Errorf("The response message is not LoginResp")
+		return nil, "", fmt.Errorf("The response message is not LoginResp")
 	}
 
 	loginResp := m.(*msg.LoginResp)
 	if loginResp.Error != "" {
-		return fmt.Errorf("%s", loginResp.Error)
+		return nil, "", fmt.Errorf("%s", loginResp.Error)
 	}
-	conn.SetReadDeadline(time.Time{})
+	return loginResp, token, nil
+}
 
-	log.Debug(loginResp)
-	c.clientId = loginResp.ClientId
-	c.conn = conn
-	return nil
+func (c *Client) getToken() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Token
 }
 
+//处理一次控制连接上的消息，连接断开后等待所有goroutine退出再返回
 func (c *Client) worker() {
-	go c.readMsg()
-	go c.writeMsg()
-	go c.msgHandler()
-
-	for {
-		select {
-
-		case _, ok := <-c.blocked:
-			if !ok {
-				close(c.sendCh)
-				close(c.receiveCh)
-
-				c.closed <- 1
-				return
-				if c.exit {
-					return
-				}
+	c.mu.Lock()
+	c.done = make(chan struct{})
+	c.mu.Unlock()
+	receiveCh := make(chan msg.Message, 10)
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(c.done)
+			c.conn.Close()
+		})
+	}
 
-				for {
-					log.Info("reconnect to server")
-					err := c.login()
-					if err != nil {
-						log.Error("reconnect to server failed:", err)
-						time.Sleep(10)
-						continue
-					}
-					break
-				}
+	var wait sync.WaitGroup
+	wait.Add(3)
+	go func() {
+		defer wait.Done()
+		defer stop()
+		c.readMsg(receiveCh)
+	}()
+	go func() {
+		defer wait.Done()
+		defer stop()
+		c.writeMsg()
+	}()
+	go func() {
+		defer wait.Done()
+		defer stop()
+		c.msgHandler(receiveCh)
+	}()
 
-				c.receiveCh = make(chan msg.Message, 10)
-				c.sendCh = make(chan msg.Message, 10)
-				c.blocked = make(chan int)
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		c.manager.CheckProxy()
+	}()
+	wait.Wait()
 
-				c.lastPong = time.Now()
-				go c.readMsg()
-				go c.writeMsg()
-				go c.msgHandler()
-			}
+	c.closeWorkConns()
 
+	//丢弃旧连接上未发送的消息，重连后会重新注册代理
+	for {
+		select {
+		case <-c.sendCh:
+			continue
+		default:
 		}
-
+		break
 	}
-
 }
 
-func (c *Client) msgHandler() {
+func (c *Client) msgHandler(receiveCh chan msg.Message) {
 
-	c.lastPong = time.Now()
+	c.setLastPong()
 	PingSend := time.NewTicker(time.Duration(c.config.PingInterval) * time.Second)
 	defer PingSend.Stop()
 
@@ -182,22 +371,19 @@ func (c *Client) msgHandler() {
 			m, err := msg.Pack(msg.TypePing, p)
 			if err != nil {
 				log.Error(err)
-				c.conn.Close()
 				return
 			}
-			c.sendCh <- m
+			if !c.sendMsg(m) {
+				return
+			}
 			log.Debug("send heartbeat to server")
 
 		case <-PongCheck.C:
-			if time.Since(c.lastPong) > time.Duration(c.config.PongTimeout)*time.Second {
+			if time.Since(c.getLastPong()) > time.Duration(c.config.PongTimeout)*time.Second {
 				log.Error("heartbeat timeout")
-				c.conn.Close()
-				return
-			}
-		case M, ok := <-c.receiveCh:
-			if !ok {
 				return
 			}
+		case M := <-receiveCh:
 			msg_type, m, err := msg.UnPack(M)
 			if err != nil {
 				log.Error(err)
@@ -209,6 +395,7 @@ func (c *Client) msgHandler() {
 				newProxyResp := m.(*msg.NewProxyResp)
 				if newProxyResp.Error != "" {
 					log.Error("Regsiter new proxy error:", newProxyResp.Error)
+					c.manager.SetProxyError(newProxyResp.ProxyName, newProxyResp.Error)
 					continue
 				}
 
@@ -219,26 +406,38 @@ func (c *Client) msgHandler() {
 				go c.NewWorkConn(*reqWorkConn)
 			case msg.TypePong:
 				log.Debug("receive pong")
-				c.lastPong = time.Now()
+				c.setLastPong()
 
 			}
 
+		case <-c.done:
+			return
 		}
 
 	}
 
 }
 
-func (c *Client) readMsg() {
+func (c *Client) setLastPong() {
+	c.mu.Lock()
+	c.lastPong = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *Client) getLastPong() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastPong
+}
+
+func (c *Client) readMsg(receiveCh chan msg.Message) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Error(err)
 		}
 	}()
 
-	defer close(c.blocked)
-
-	conn := utils.NewReader(c.conn, []byte(c.config.Token))
+	conn := utils.NewReader(c.conn, []byte(c.getToken()))
 
 	for {
 		if m, err := msg.ReadRawMsg(conn); err != nil {
@@ -251,7 +450,11 @@ func (c *Client) readMsg() {
 			}
 
 		} else {
-			c.receiveCh <- m
+			select {
+			case receiveCh <- m:
+			case <-c.done:
+				return
+			}
 		}
 
 	}
@@ -259,29 +462,70 @@ func (c *Client) readMsg() {
 }
 
 func (c *Client) writeMsg() {
-	conn, err := utils.NewWriter(c.conn, []byte(c.config.Token))
+	conn, err := utils.NewWriter(c.conn, []byte(c.getToken()))
 	if err != nil {
 		log.Error(err)
-		c.conn.Close()
 		return
 	}
 
 	for {
-		if m, ok := <-c.sendCh; !ok {
-			log.Warn("send message chan closed")
-			return
-		} else {
+		select {
+		case m := <-c.sendCh:
 			if err := msg.WriteRawMsg(m, conn); err != nil {
 				log.Error(err)
 				return
 			}
-
+		case <-c.done:
+			return
 		}
 
 	}
 
 }
 
+//控制连接断开时返回false
+func (c *Client) sendMsg(M msg.Message) bool {
+	c.mu.RLock()
+	done := c.done
+	c.mu.RUnlock()
+
+	select {
+	case c.sendCh <- M:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (c *Client) addWorkConn(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	c.workConns[conn] = struct{}{}
+	return true
+}
+
+func (c *Client) removeWorkConn(conn net.Conn) {
+	c.mu.Lock()
+	delete(c.workConns, conn)
+	c.mu.Unlock()
+}
+
+func (c *Client) closeWorkConns() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for conn := range c.workConns {
+		conn.Close()
+	}
+	c.workConns = make(map[net.Conn]struct{})
+}
+
 func (c *Client) NewWorkConn(rm msg.ReqWorkConn) {
 	workConn, err := c.ConnectToServer()
 	if err != nil {
@@ -289,9 +533,11 @@ func (c *Client) NewWorkConn(rm msg.ReqWorkConn) {
 		return
 	}
 
+	c.mu.RLock()
 	m := msg.NewWorkConn{
 		ClientId: c.clientId,
 	}
+	c.mu.RUnlock()
 
 	err = msg.WriteMsg(msg.TypeNewWorkConn, m, workConn)
 	if err != nil {
@@ -300,24 +546,65 @@ func (c *Client) NewWorkConn(rm msg.ReqWorkConn) {
 		return
 	}
 
+	if !c.addWorkConn(workConn) {
+		workConn.Close()
+		return
+	}
 	msg_type, sm, err2 := msg.ReadMsg(workConn)
+	c.removeWorkConn(workConn)
 	if err2 != nil {
-		log.Error("read StartWork msg error:", err2)
+		log.Debug("read StartWork msg error:", err2)
+		workConn.Close()
 		return
 	}
 	if msg_type != msg.TypeStartWork {
 		log.Error("msg type is not StartWork")
+		workConn.Close()
 		return
 	}
 
-	c.manager.ProxyWork(sm.(*msg.StartWork).ProxyName, workConn)
+	c.manager.ProxyWork(sm.(*msg.StartWork), workConn)
 }
 
 func (c *Client) ConnectToServer() (net.Conn, error) {
+	if c.config.Mux {
+		return c.openStream()
+	}
+	return c.dialServer()
+}
+
+func (c *Client) dialServer() (net.Conn, error) {
 	server_addr := fmt.Sprintf("%s:%d", c.config.ServerIP, c.config.ServerPort)
 	tcp_addr, err := net.ResolveTCPAddr("tcp", server_addr)
 	if err != nil {
 		return nil, err
 	}
-	return net.DialTCP("tcp", nil, tcp_addr)
+	conn, err := net.DialTCP("tcp", nil, tcp_addr)
+	if err != nil || c.tlsConfig == nil {
+		return conn, err
+	}
+
+	tlsConn := tls.Client(conn, c.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(ReadTimeout))
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+//多路复用模式下，所有连接都是同一个会话上的逻辑流，会话断开后重新建立
+func (c *Client) openStream() (net.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session == nil || c.session.IsClosed() {
+		conn, err := c.dialServer()
+		if err != nil {
+			return nil, err
+		}
+		c.session = utils.NewSession(conn, true)
+	}
+	return c.session.Open()
 }
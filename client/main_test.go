@@ -0,0 +1,13 @@
+package client
+
+import (
+	"os"
+	"testing"
+
+	log "github.com/cihub/seelog"
+)
+
+func TestMain(m *testing.M) {
+	log.ReplaceLogger(log.Disabled)
+	os.Exit(m.Run())
+}
@@ -1,12 +1,16 @@
 package client
 
 import (
+	"fmt"
 	"net"
+	"reflect"
+	"sort"
 	"sync"
 
 	log "github.com/cihub/seelog"
 	"proxy/config"
 	msg "proxy/message"
+	"proxy/utils"
 )
 
 const (
@@ -15,21 +19,52 @@ const (
 	ProxyStatusClosed  = 2 //"closed"
 )
 
+func StatusName(status int) string {
+	switch status {
+	case ProxyStatusNew:
+		return "new"
+	case ProxyStatusRunning:
+		return "running"
+	case ProxyStatusClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+//管理接口中展示的代理状态
+type ProxyStatus struct {
+	Name       string              `json:"name"`
+	Type       string              `json:"type"`
+	Status     string              `json:"status"`
+	LastError  string              `json:"last_error"`
+	LocalAddr  string              `json:"local_addr"`
+	RemotePort int                 `json:"remote_port,omitempty"`
+	Domain     string              `json:"domain,omitempty"`
+	Url        string              `json:"url,omitempty"`
+	Traffic    utils.TrafficStats  `json:"traffic"`
+	Compress   utils.CompressStats `json:"compress"`
+}
+
+//重新加载配置后发生变化的代理
+type ReloadResult struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
 type Manager struct {
 	client       *Client
 	allProxyConf []*config.ProxyConf
 	proxies      map[string]Proxy
-	sendCh       chan (msg.Message)
 
 	closed bool
 	mu     sync.RWMutex
 }
 
-func NewManager(client *Client, proxy_conf []*config.ProxyConf, sendCh chan (msg.Message)) (m *Manager) {
+func NewManager(client *Client, proxy_conf []*config.ProxyConf) (m *Manager) {
 	m = &Manager{
 		client:       client,
 		allProxyConf: proxy_conf,
-		sendCh:       sendCh,
 		proxies:      make(map[string]Proxy),
 		closed:       false,
 	}
@@ -43,16 +78,8 @@ func NewManager(client *Client, proxy_conf []*config.ProxyConf, sendCh chan (msg
 	return
 }
 
-func (m *Manager) sendMsg(M msg.Message) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Error(err)
-			m.closed = true
-		}
-
-	}()
-	m.sendCh <- M
-	return
+func (m *Manager) sendMsg(M msg.Message) bool {
+	return m.client.sendMsg(M)
 }
 
 func (m *Manager) CheckProxy() {
@@ -66,13 +93,32 @@ func (m *Manager) CheckProxy() {
 				continue
 			}
 			newProxyMsg := msg.NewProxy{
-				ProxyName:  pxy.GetName(),
-				ProxyType:  pxy.GetType(),
-				RemotePort: pxy.GetRemotePort(),
-				Encrypt:    pxy.GetConfig().Encryption,
-				Host:       pxy.GetConfig().LocalIP,
-				Domain:     pxy.GetConfig().Domain,
-				Url:        pxy.GetConfig().Url,
+				ProxyName:     pxy.GetName(),
+				ProxyType:     pxy.GetType(),
+				RemotePort:    pxy.GetRemotePort(),
+				Encrypt:       pxy.GetConfig().Encryption,
+				EncryptMethod: EncryptMethod(pxy.GetConfig()),
+				Compression:   pxy.GetConfig().Compression,
+				Host:          pxy.GetConfig().LocalIP,
+				Domain:        pxy.GetConfig().Domain,
+				Url:           pxy.GetConfig().Url,
+				Subdomain:     pxy.GetConfig().Subdomain,
+				Group:         pxy.GetConfig().Group,
+				GroupKey:      pxy.GetConfig().GroupKey,
+				Weight:        pxy.GetConfig().Weight,
+				LoadBalance:   pxy.GetConfig().LoadBalance,
+
+				HostHeaderRewrite:     pxy.GetConfig().HostHeaderRewrite,
+				RequestHeaders:        pxy.GetConfig().RequestHeaders,
+				RemoveRequestHeaders:  pxy.GetConfig().RemoveRequestHeaders,
+				ResponseHeaders:       pxy.GetConfig().ResponseHeaders,
+				RemoveResponseHeaders: pxy.GetConfig().RemoveResponseHeaders,
+				RewritePath:           pxy.GetConfig().RewritePath,
+
+				HttpUser: pxy.GetConfig().HttpUser,
+				HttpPwd:  pxy.GetConfig().HttpPwd,
+				AllowIPs: pxy.GetConfig().AllowIPs,
+				DenyIPs:  pxy.GetConfig().DenyIPs,
 			}
 
 			M, err := msg.Pack(msg.TypeNewProxy, newProxyMsg)
@@ -81,7 +127,9 @@ func (m *Manager) CheckProxy() {
 				return
 			}
 			log.Debug("send new proxy msg")
-			m.sendMsg(M)
+			if !m.sendMsg(M) {
+				return
+			}
 		}
 	}
 }
@@ -113,17 +161,137 @@ func (m *Manager) StartProxy(name string, remote_port int) {
 		return
 	}
 
-	pxy.GetConfig().RemotePort = remote_port
+	pxy.SetServerPort(remote_port)
+	pxy.SetLastError("")
 	pxy.Run()
 	return
 }
 
-func (m *Manager) ProxyWork(name string, conn net.Conn) {
-	m.mu.RLock()
+//记录代理注册失败的原因，已经在运行的代理忽略重复注册产生的错误
+func (m *Manager) SetProxyError(name string, err string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	pxy, ok := m.proxies[name]
+	if !ok || IsRunning(pxy) {
+		return
+	}
+	pxy.SetLastError(err)
+}
+
+func (m *Manager) GetStatus() []ProxyStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]ProxyStatus, 0, len(m.proxies))
+	for _, pxy := range m.proxies {
+		cfg := pxy.GetConfig()
+		list = append(list, ProxyStatus{
+			Name:       pxy.GetName(),
+			Type:       pxy.GetType(),
+			Status:     StatusName(pxy.GetStatus()),
+			LastError:  pxy.GetLastError(),
+			LocalAddr:  fmt.Sprintf("%s:%d", cfg.LocalIP, cfg.LocalPort),
+			RemotePort: pxy.GetServerPort(),
+			Domain:     cfg.Domain,
+			Url:        cfg.Url,
+			Traffic:    pxy.GetTrafficStats(),
+			Compress:   pxy.GetCompressStats(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+//比较新旧代理配置，按名称找出新增、删除和修改的代理
+func DiffProxyConf(oldConf, newConf map[string]*config.ProxyConf) (result ReloadResult) {
+	for name, cfg := range oldConf {
+		newCfg, ok := newConf[name]
+		if !ok {
+			result.Removed = append(result.Removed, name)
+		} else if !reflect.DeepEqual(newCfg, cfg) {
+			result.Changed = append(result.Changed, name)
+		}
+	}
+	for name := range newConf {
+		if _, ok := oldConf[name]; !ok {
+			result.Added = append(result.Added, name)
+		}
+	}
+
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+	sort.Strings(result.Changed)
+	return
+}
+
+//使用新的代理配置替换当前配置，没有变化的代理保持原样，
+//删除和修改的代理在本地关闭并断开其工作连接，需要调用者通知服务器
+func (m *Manager) Reload(proxy_conf []*config.ProxyConf) (result ReloadResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newConf := make(map[string]*config.ProxyConf)
+	for _, cfg := range proxy_conf {
+		if NewProxy(cfg, m.client.getToken()) == nil {
+			log.Error("reload proxy [", cfg.Name, "] error:unknown proxy type ", cfg.Type)
+			continue
+		}
+		if _, ok := newConf[cfg.Name]; !ok {
+			newConf[cfg.Name] = cfg
+		}
+	}
+
+	oldConf := make(map[string]*config.ProxyConf)
+	for name, pxy := range m.proxies {
+		oldConf[name] = pxy.GetConfig()
+	}
+
+	result = DiffProxyConf(oldConf, newConf)
+	for _, name := range result.Removed {
+		m.proxies[name].Close()
+		delete(m.proxies, name)
+	}
+	for _, name := range result.Changed {
+		m.proxies[name].Close()
+		m.proxies[name] = NewProxy(newConf[name], m.client.getToken())
+	}
+	for _, name := range result.Added {
+		m.proxies[name] = NewProxy(newConf[name], m.client.getToken())
+	}
+
+	m.allProxyConf = proxy_conf
+	return
+}
+
+//登录后更新代理加密使用的密钥
+func (m *Manager) SetToken(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, pxy := range m.proxies {
+		pxy.SetToken(token)
+	}
+}
+
+//控制连接断开后，所有代理都需要重新注册
+func (m *Manager) ResetProxies() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, pxy := range m.proxies {
+		pxy.SetStatus(ProxyStatusNew)
+	}
+}
+
+func (m *Manager) ProxyWork(sm *msg.StartWork, conn net.Conn) {
+	m.mu.RLock()
+	pxy, ok := m.proxies[sm.ProxyName]
 	m.mu.RUnlock()
 	if ok {
-		pxy.Work(conn)
+		pxy.Work(conn, sm)
 	} else {
 		conn.Close()
 	}
@@ -5,22 +5,37 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	log "github.com/cihub/seelog"
 	"proxy/config"
+	msg "proxy/message"
 	"proxy/utils"
 )
 
+//udp访问者在该时间内没有数据往来，则关闭对应的本地连接
+var UdpPeerTimeout time.Duration = 60 * time.Second
+
 type Proxy interface {
-	Work(conn net.Conn)
+	Work(conn net.Conn, m *msg.StartWork)
 	Run() error
 
 	GetName() string
 	GetType() string
 	GetRemotePort() int
 	GetToken() string
+	SetToken(token string)
 	GetStatus() int
+	SetStatus(status int)
 	GetConfig() *config.ProxyConf
+	GetCompressStats() utils.CompressStats
+	GetTrafficStats() utils.TrafficStats
+
+	//服务器实际分配的端口和最近一次注册失败的原因
+	GetServerPort() int
+	SetServerPort(port int)
+	GetLastError() string
+	SetLastError(err string)
 
 	Close()
 }
@@ -30,8 +45,10 @@ func NewProxy(cfg *config.ProxyConf, token string) (pxy Proxy) {
 		Name:       cfg.Name,
 		Type:       cfg.Type,
 		RemotePort: cfg.RemotePort,
-		Token:      token,
+		token:      token,
 		cfg:        cfg,
+		mu:         &sync.RWMutex{},
+		workConns:  newConnSet(),
 	}
 	switch cfg.Type {
 	case "tcp":
@@ -48,6 +65,10 @@ func NewProxy(cfg *config.ProxyConf, token string) (pxy Proxy) {
 		pxy = &HttpsProxy{
 			BaseProxy: baseProxy,
 		}
+	case "udp":
+		pxy = &UdpProxy{
+			BaseProxy: baseProxy,
+		}
 	case "extranet":
 		pxy = &ExtranetProxy{
 			BaseProxy: baseProxy,
@@ -60,10 +81,70 @@ type BaseProxy struct {
 	Name       string
 	Type       string
 	RemotePort int
-	Token      string
-	Status     int
 
 	cfg *config.ProxyConf
+
+	//由控制连接、工作连接和管理接口在不同的goroutine中读写
+	mu         *sync.RWMutex
+	token      string
+	status     int
+	serverPort int
+	lastError  string
+
+	compressStats utils.CompressStats
+	trafficStats  utils.TrafficStats
+
+	//正在使用的工作连接，代理被删除或修改时全部关闭
+	workConns *connSet
+}
+
+type connSet struct {
+	conns  map[net.Conn]struct{}
+	closed bool
+	mu     sync.Mutex
+}
+
+func newConnSet() *connSet {
+	return &connSet{
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *connSet) add(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *connSet) remove(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+func (s *connSet) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = make(map[net.Conn]struct{})
+}
+
+//记录工作连接并统计流量，代理已关闭时返回nil
+func (b *BaseProxy) trackWorkConn(conn net.Conn) net.Conn {
+	if !b.workConns.add(conn) {
+		conn.Close()
+		return nil
+	}
+	return utils.NewStatsConn(conn, &b.trafficStats)
 }
 
 func (b *BaseProxy) GetName() string {
@@ -76,14 +157,54 @@ func (b *BaseProxy) GetRemotePort() int {
 	return b.RemotePort
 }
 func (b *BaseProxy) GetToken() string {
-	return b.Token
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.token
+}
+func (b *BaseProxy) SetToken(token string) {
+	b.mu.Lock()
+	b.token = token
+	b.mu.Unlock()
 }
 func (b *BaseProxy) GetStatus() int {
-	return b.Status
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.status
+}
+func (b *BaseProxy) SetStatus(status int) {
+	b.mu.Lock()
+	b.status = status
+	b.mu.Unlock()
 }
 func (b *BaseProxy) GetConfig() *config.ProxyConf {
 	return b.cfg
 }
+func (b *BaseProxy) GetCompressStats() utils.CompressStats {
+	return b.compressStats.Snapshot()
+}
+func (b *BaseProxy) GetTrafficStats() utils.TrafficStats {
+	return b.trafficStats.Snapshot()
+}
+func (b *BaseProxy) GetServerPort() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.serverPort
+}
+func (b *BaseProxy) SetServerPort(port int) {
+	b.mu.Lock()
+	b.serverPort = port
+	b.mu.Unlock()
+}
+func (b *BaseProxy) GetLastError() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.lastError
+}
+func (b *BaseProxy) SetLastError(err string) {
+	b.mu.Lock()
+	b.lastError = err
+	b.mu.Unlock()
+}
 
 type HttpProxy struct {
 	BaseProxy
@@ -92,16 +213,20 @@ type HttpProxy struct {
 
 func (pxy *HttpProxy) Run() error {
 	log.Debug("http proxy is running")
-	pxy.Status = ProxyStatusRunning
+	pxy.SetStatus(ProxyStatusRunning)
 	return nil
 }
 
-func (pxy *HttpProxy) Work(conn net.Conn) {
-	Handler(pxy.cfg, conn, pxy.Token)
+func (pxy *HttpProxy) Work(conn net.Conn, m *msg.StartWork) {
+	if c := pxy.trackWorkConn(conn); c != nil {
+		defer pxy.workConns.remove(conn)
+		Handler(pxy.cfg, c, pxy.GetToken(), &pxy.compressStats, nil)
+	}
 }
 
 func (pxy *HttpProxy) Close() {
-
+	pxy.SetStatus(ProxyStatusClosed)
+	pxy.workConns.close()
 }
 
 type HttpsProxy struct {
@@ -110,15 +235,21 @@ type HttpsProxy struct {
 }
 
 func (pxy *HttpsProxy) Run() error {
-	pxy.Status = ProxyStatusRunning
+	log.Debug("https proxy is running")
+	pxy.SetStatus(ProxyStatusRunning)
 	return nil
 }
 
-func (pxy *HttpsProxy) Work(conn net.Conn) {
+func (pxy *HttpsProxy) Work(conn net.Conn, m *msg.StartWork) {
+	if c := pxy.trackWorkConn(conn); c != nil {
+		defer pxy.workConns.remove(conn)
+		Handler(pxy.cfg, c, pxy.GetToken(), &pxy.compressStats, m)
+	}
 }
 
 func (pxy *HttpsProxy) Close() {
-
+	pxy.SetStatus(ProxyStatusClosed)
+	pxy.workConns.close()
 }
 
 type TcpProxy struct {
@@ -127,15 +258,42 @@ type TcpProxy struct {
 }
 
 func (pxy *TcpProxy) Run() error {
-	pxy.Status = ProxyStatusRunning
+	pxy.SetStatus(ProxyStatusRunning)
 	return nil
 }
 
-func (pxy *TcpProxy) Work(conn net.Conn) {
+func (pxy *TcpProxy) Work(conn net.Conn, m *msg.StartWork) {
+	if c := pxy.trackWorkConn(conn); c != nil {
+		defer pxy.workConns.remove(conn)
+		Handler(pxy.cfg, c, pxy.GetToken(), &pxy.compressStats, m)
+	}
 }
 
 func (pxy *TcpProxy) Close() {
+	pxy.SetStatus(ProxyStatusClosed)
+	pxy.workConns.close()
+}
+
+type UdpProxy struct {
+	BaseProxy
+	closed bool
+}
+
+func (pxy *UdpProxy) Run() error {
+	pxy.SetStatus(ProxyStatusRunning)
+	return nil
+}
+
+func (pxy *UdpProxy) Work(conn net.Conn, m *msg.StartWork) {
+	if c := pxy.trackWorkConn(conn); c != nil {
+		defer pxy.workConns.remove(conn)
+		UdpHandler(pxy.cfg, c, pxy.GetToken(), &pxy.compressStats)
+	}
+}
 
+func (pxy *UdpProxy) Close() {
+	pxy.SetStatus(ProxyStatusClosed)
+	pxy.workConns.close()
 }
 
 type ExtranetProxy struct {
@@ -148,7 +306,7 @@ func (pxy *ExtranetProxy) Run() error {
 
 }
 
-func (pxy *ExtranetProxy) Work(conn net.Conn) {
+func (pxy *ExtranetProxy) Work(conn net.Conn, m *msg.StartWork) {
 
 }
 
@@ -156,22 +314,36 @@ func (pxy *ExtranetProxy) Close() {
 
 }
 
-func Handler(cfg *config.ProxyConf, conn net.Conn, token string) {
-	defer conn.Close()
-	var err error
-	var remote io.ReadWriteCloser
+func EncryptMethod(cfg *config.ProxyConf) string {
+	if cfg.EncryptionMethod == "" {
+		return utils.EncryptMethodGcm
+	}
+	return cfg.EncryptionMethod
+}
+
+//先加密再压缩，写入的数据会先被压缩
+func wrapWorkConn(cfg *config.ProxyConf, conn net.Conn, token string, stats *utils.CompressStats) (remote net.Conn, err error) {
 	remote = conn
 	if cfg.Encryption {
-		remote, err = utils.Encryption(conn, []byte(token))
-		if err != nil {
-			log.Error("proxy handler error:", err)
+		if remote, err = utils.Encryption(conn, []byte(token), EncryptMethod(cfg), utils.RoleClient); err != nil {
 			return
 		}
 	}
+	return utils.Compression(remote, cfg.Compression, stats)
+}
+
+//m不为空且配置了proxy_protocol_version时，连接本地服务后先发送PROXY protocol头部
+func Handler(cfg *config.ProxyConf, conn net.Conn, token string, stats *utils.CompressStats, m *msg.StartWork) {
+	defer conn.Close()
+	remote, err := wrapWorkConn(cfg, conn, token, stats)
+	if err != nil {
+		log.Error("proxy handler error:", err)
+		return
+	}
 
 	local_server_addr := fmt.Sprintf("%s:%d", cfg.LocalIP, cfg.LocalPort)
 	tcp_addr, err1 := net.ResolveTCPAddr("tcp", local_server_addr)
-	if err != nil {
+	if err1 != nil {
 		log.Error("ResolveT addr error:", err1)
 		return
 	}
@@ -179,28 +351,120 @@ func Handler(cfg *config.ProxyConf, conn net.Conn, token string) {
 	localConn, err2 := net.DialTCP("tcp", nil, tcp_addr)
 	if err2 != nil {
 		log.Error("connect to local server ", local_server_addr, " error:", err2)
+		return
 	}
 	defer localConn.Close()
 
+	if m != nil && cfg.ProxyProtocolVersion != "" {
+		header, err := utils.ProxyProtocolHeader(cfg.ProxyProtocolVersion, m.SrcAddr, m.DstAddr)
+		if err != nil {
+			log.Error("proxy [", cfg.Name, "] build proxy protocol header error:", err)
+			return
+		}
+		if _, err = localConn.Write(header); err != nil {
+			log.Error("proxy [", cfg.Name, "] write proxy protocol header error:", err)
+			return
+		}
+	}
+
 	BridgeConn(remote, localConn)
 	log.Debug("bridgeconn over")
 }
 
-func BridgeConn(conn1, conn2 io.ReadWriteCloser) {
-	var wait sync.WaitGroup
-	wait.Add(2)
+//在工作连接和本地udp服务之间转发数据包，每个访问者对应一个本地udp连接
+func UdpHandler(cfg *config.ProxyConf, conn net.Conn, token string, stats *utils.CompressStats) {
+	defer conn.Close()
+	remote, err := wrapWorkConn(cfg, conn, token, stats)
+	if err != nil {
+		log.Error("udp proxy handler error:", err)
+		return
+	}
 
-	Copy := func(dst, src io.ReadWriteCloser) {
-		defer wait.Done()
+	local_server_addr := fmt.Sprintf("%s:%d", cfg.LocalIP, cfg.LocalPort)
+	udp_addr, err := net.ResolveUDPAddr("udp", local_server_addr)
+	if err != nil {
+		log.Error("Resolve udp addr error:", err)
+		return
+	}
+
+	//map[remoteAddr]localConn
+	peers := make(map[string]*net.UDPConn)
+	var mu sync.Mutex
+	var writeMu sync.Mutex
+
+	readLocal := func(remoteAddr string, localConn *net.UDPConn) {
+		defer func() {
+			mu.Lock()
+			if peers[remoteAddr] == localConn {
+				delete(peers, remoteAddr)
+			}
+			mu.Unlock()
+			localConn.Close()
+		}()
+
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := localConn.Read(buf)
+			if err != nil {
+				log.Debug("udp peer ", remoteAddr, " closed:", err)
+				return
+			}
+			localConn.SetReadDeadline(time.Now().Add(UdpPeerTimeout))
 
-		buf := make([]byte, 16*1024)
-		io.CopyBuffer(dst, src, buf)
+			pkt := msg.UdpPacket{
+				Content:    buf[:n],
+				RemoteAddr: remoteAddr,
+			}
+			writeMu.Lock()
+			err = msg.WriteMsg(msg.TypeUdpPacket, pkt, remote)
+			writeMu.Unlock()
+			if err != nil {
+				log.Error("write udp packet to server error:", err)
+				return
+			}
+		}
 	}
 
-	go Copy(conn2, conn1)
-	go Copy(conn1, conn2)
-	wait.Wait()
+	defer func() {
+		mu.Lock()
+		for _, localConn := range peers {
+			localConn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	for {
+		msgType, m, err := msg.ReadMsg(remote)
+		if err != nil {
+			log.Debug("udp work connection closed:", err)
+			return
+		}
+		if msgType != msg.TypeUdpPacket {
+			continue
+		}
+		pkt := m.(*msg.UdpPacket)
+
+		mu.Lock()
+		localConn, ok := peers[pkt.RemoteAddr]
+		if !ok {
+			localConn, err = net.DialUDP("udp", nil, udp_addr)
+			if err != nil {
+				mu.Unlock()
+				log.Error("connect to local udp server ", local_server_addr, " error:", err)
+				continue
+			}
+			peers[pkt.RemoteAddr] = localConn
+			go readLocal(pkt.RemoteAddr, localConn)
+		}
+		mu.Unlock()
+
+		localConn.SetReadDeadline(time.Now().Add(UdpPeerTimeout))
+		localConn.Write(pkt.Content)
+	}
+}
 
+func BridgeConn(conn1, conn2 io.ReadWriteCloser) {
+	utils.BridgeConn(conn1, conn2)
 }
 func copyBuffer(dst io.Writer, src io.Reader, buf []byte) (written int64, err error) {
 	if buf == nil {
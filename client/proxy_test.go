@@ -0,0 +1,133 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"proxy/config"
+	msg "proxy/message"
+)
+
+//本地udp服务，把收到的数据和发送方的地址一起返回
+func newUdpAddrEchoServer(t *testing.T) int {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append(buf[:n:n], " from "+addr.String()...), addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+//模拟服务器一侧的工作连接，返回发送数据包和读取回复的函数
+func startUdpHandler(t *testing.T, localPort int) (send func(remoteAddr, content string), recv func() *msg.UdpPacket) {
+	server, conn := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	cfg := &config.ProxyConf{Name: "udp", Type: "udp", LocalIP: "127.0.0.1", LocalPort: localPort}
+	go UdpHandler(cfg, conn, "", nil)
+
+	send = func(remoteAddr, content string) {
+		pkt := msg.UdpPacket{Content: []byte(content), RemoteAddr: remoteAddr}
+		if err := msg.WriteMsg(msg.TypeUdpPacket, pkt, server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv = func() *msg.UdpPacket {
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msgType, m, err := msg.ReadMsg(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != msg.TypeUdpPacket {
+			t.Fatal("unexpected message type", msgType)
+		}
+		return m.(*msg.UdpPacket)
+	}
+	return
+}
+
+//每个访问者使用独立的本地连接，回复带上对应的访问者地址
+func TestUdpHandlerRoundTrip(t *testing.T) {
+	send, recv := startUdpHandler(t, newUdpAddrEchoServer(t))
+
+	locals := make(map[string]string)
+	for _, peer := range []string{"1.1.1.1:1000", "2.2.2.2:2000", "1.1.1.1:1000"} {
+		send(peer, "ping")
+		pkt := recv()
+		if pkt.RemoteAddr != peer {
+			t.Fatalf("reply for %s is sent to %s", peer, pkt.RemoteAddr)
+		}
+		local := localAddr(t, pkt)
+		if old, ok := locals[peer]; ok && old != local {
+			t.Fatalf("peer %s uses a new local connection before timeout", peer)
+		}
+		locals[peer] = local
+	}
+	if locals["1.1.1.1:1000"] == locals["2.2.2.2:2000"] {
+		t.Fatal("two peers share one local connection")
+	}
+}
+
+//访问者超过UdpPeerTimeout没有数据往来时，本地连接被关闭，之后的数据使用新连接
+func TestUdpHandlerPeerTimeout(t *testing.T) {
+	old := UdpPeerTimeout
+	UdpPeerTimeout = 200 * time.Millisecond
+	defer func() { UdpPeerTimeout = old }()
+
+	send, recv := startUdpHandler(t, newUdpAddrEchoServer(t))
+	send("1.1.1.1:1000", "ping")
+	first := localAddr(t, recv())
+
+	time.Sleep(3 * UdpPeerTimeout)
+	send("1.1.1.1:1000", "ping")
+	second := localAddr(t, recv())
+	if first == second {
+		t.Fatalf("local connection is not expired: %q, %q", first, second)
+	}
+}
+
+//从回复 "ping from 127.0.0.1:port" 中取出本地连接的地址
+func localAddr(t *testing.T, pkt *msg.UdpPacket) string {
+	parts := strings.SplitN(string(pkt.Content), " from ", 2)
+	if len(parts) != 2 {
+		t.Fatalf("bad reply %q", pkt.Content)
+	}
+	return parts[1]
+}
+
+//重连时更新token和状态，同时工作连接和管理接口在读取，需要用-race运行
+func TestBaseProxyConcurrentAccess(t *testing.T) {
+	pxy := NewProxy(&config.ProxyConf{Name: "echo", Type: "tcp"}, "old")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			pxy.SetToken("new")
+			pxy.SetStatus(ProxyStatusNew)
+			pxy.SetLastError("error")
+			pxy.Run()
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		pxy.GetToken()
+		StatusName(pxy.GetStatus())
+		pxy.GetLastError()
+	}
+	<-done
+
+	if pxy.GetToken() != "new" || pxy.GetStatus() != ProxyStatusRunning {
+		t.Fatal("unexpected proxy state:", pxy.GetToken(), pxy.GetStatus())
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/cihub/seelog"
 	"proxy/client"
@@ -28,7 +31,22 @@ func main() {
 		return
 	}
 
-	Client := client.NewClient(clientCfg)
+	Client, err := client.NewClient(clientCfg)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	//收到SIGHUP时重新加载代理配置，不影响没有变化的代理
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			if _, err := Client.Reload(); err != nil {
+				log.Error("reload config error:", err)
+			}
+		}
+	}()
 
 	Client.Run()
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/cihub/seelog"
 	"proxy/config"
@@ -9,6 +12,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		os.Exit(runUserCmd(os.Args[2:]))
+	}
+
 	config_file := flag.String("config", "./config/config.toml", "Input your server configure file")
 	log_file := flag.String("logconfig", "./config/logcfg.xml", "Input your log configure file")
 
@@ -35,6 +42,26 @@ func main() {
 		log.Error(err)
 		return
 	}
+	//收到SIGHUP时重新加载配置文件和用户token文件
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			if _, err := Service.Reload(); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+
+	//收到SIGINT或SIGTERM时停止服务，Run返回后退出
+	stopCh := make(chan os.Signal, 1)
+	signal.Notify(stopCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stopCh
+		log.Info("service stop")
+		Service.Close()
+	}()
+
 	log.Info("service start")
 	Service.Run()
 
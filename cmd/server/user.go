@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"proxy/config"
+)
+
+const userUsage = `usage: server user <add|del|list|rotate> [-config file] [name]
+
+  add     add a user and print the generated token
+  del     delete a user
+  list    list all users
+  rotate  generate a new token for a user
+
+The running server reloads the user token file automatically.`
+
+//管理用户token文件，文件中只保存token的校验值
+func runUserCmd(args []string) int {
+	fs := flag.NewFlagSet("user", flag.ContinueOnError)
+	config_file := fs.String("config", "./config/config.toml", "Input your server configure file")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, userUsage)
+	}
+
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	cmd := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	serverCfg, err := config.NewServerConfWithFile(*config_file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	file := serverCfg.UserTokenFile
+
+	if cmd == "list" {
+		userToken := make(config.UserTokenMap)
+		if err = userToken.ReadUserTokenMap(file); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, user := range userToken.Users() {
+			fmt.Println(user)
+		}
+		return 0
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	user := fs.Arg(0)
+
+	var token string
+	switch cmd {
+	case "add":
+		err = config.UpdateUserTokenFile(file, func(u config.UserTokenMap) (err error) {
+			token, err = u.AddUser(user)
+			return
+		})
+	case "del":
+		err = config.UpdateUserTokenFile(file, func(u config.UserTokenMap) error {
+			return u.DelUser(user)
+		})
+	case "rotate":
+		err = config.UpdateUserTokenFile(file, func(u config.UserTokenMap) (err error) {
+			token, err = u.RotateUser(user)
+			return
+		})
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if token != "" {
+		fmt.Printf("user: %s\ntoken: %s\n", user, token)
+	} else {
+		fmt.Printf("user %s deleted\n", user)
+	}
+	return 0
+}
@@ -13,7 +13,23 @@ type ClientConfig struct {
 	PingInterval  int          `toml:"ping_interval"`
 	PongTimeout   int          `toml:"pong_timeout"`
 	ConnPoolCount int          `toml:"conn_pool_count"`
+	Mux           bool         `toml:"mux"` //控制连接和工作连接复用同一条tcp连接
 	AllProxy      []*ProxyConf `toml:"proxy"`
+
+	//tls_trusted_ca_file为空时使用系统根证书校验服务器，tls_cert_file和tls_key_file用于双向认证
+	TlsEnable        bool   `toml:"tls_enable"`
+	TlsCertFile      string `toml:"tls_cert_file"`
+	TlsKeyFile       string `toml:"tls_key_file"`
+	TlsTrustedCaFile string `toml:"tls_trusted_ca_file"`
+	TlsServerName    string `toml:"tls_server_name"`
+
+	//本地管理接口，为空时不开启；开启时必须配置admin_user和admin_pwd，使用basic认证
+	AdminAddr string `toml:"admin_addr"`
+	AdminUser string `toml:"admin_user"`
+	AdminPwd  string `toml:"admin_pwd"`
+
+	//配置文件路径，重新加载代理配置时使用
+	ConfigFile string `toml:"-"`
 }
 
 //所以客户端proxy的配置
@@ -21,6 +37,10 @@ type ProxyConf struct {
 	Name       string `toml:"name"`
 	Type       string `toml:"type"`
 	Encryption bool   `toml:"encryption"`
+	//"aes-gcm"(默认)或旧版本使用的"cfb"
+	EncryptionMethod string `toml:"encryption_method"`
+	//"snappy"、"gzip"或"none"，先压缩再加密
+	Compression string `toml:"compression"`
 
 	LocalIP    string `toml:"local_ip"`
 	LocalPort  int    `toml:"local_port"`
@@ -28,6 +48,34 @@ type ProxyConf struct {
 
 	Domain string `toml:"domain"`
 	Url    string `toml:"url"`
+	//http代理使用服务器的subdomain_host，与domain二选一
+	Subdomain string `toml:"subdomain"`
+
+	//tcp和http代理可以加入分组，同一分组的代理共享端口或路由，由服务器做负载均衡
+	Group       string `toml:"group"`
+	GroupKey    string `toml:"group_key"`
+	Weight      int    `toml:"weight"`
+	LoadBalance string `toml:"load_balance"` //"round_robin"(默认)、"weighted"或"ip_hash"
+
+	//tcp和https代理连接本地服务时发送PROXY protocol头部携带访问者地址，"v1"或"v2"，为空时不发送
+	ProxyProtocolVersion string `toml:"proxy_protocol_version"`
+
+	//http代理改写发往本地服务的Host头部，为空时使用local_ip
+	HostHeaderRewrite string `toml:"host_header_rewrite"`
+	//http代理设置或删除的请求头部和响应头部，先删除再设置
+	RequestHeaders        map[string]string `toml:"request_headers"`
+	RemoveRequestHeaders  []string          `toml:"remove_request_headers"`
+	ResponseHeaders       map[string]string `toml:"response_headers"`
+	RemoveResponseHeaders []string          `toml:"remove_response_headers"`
+	//http代理把请求路径中的url前缀替换为rewrite_path，如url = "/api"、rewrite_path = "/"时/api/users变为/users
+	RewritePath string `toml:"rewrite_path"`
+
+	//http代理的basic认证，由服务器在转发前检查
+	HttpUser string `toml:"http_user"`
+	HttpPwd  string `toml:"http_pwd"`
+	//http代理允许和拒绝的访问者地址，CIDR或单个IP，deny_ips优先
+	AllowIPs []string `toml:"allow_ips"`
+	DenyIPs  []string `toml:"deny_ips"`
 }
 
 func NewClientConfWithFile(file_name string) (client_conf *ClientConfig, err error) {
@@ -37,6 +85,9 @@ func NewClientConfWithFile(file_name string) (client_conf *ClientConfig, err err
 	}
 
 	client_conf = new(ClientConfig)
-	_, err = toml.Decode(string(data), client_conf)
+	if _, err = toml.Decode(string(data), client_conf); err != nil {
+		return nil, err
+	}
+	client_conf.ConfigFile = file_name
 	return
 }
@@ -1,25 +1,57 @@
 package config
 
 import (
+	"fmt"
 	"github.com/toml"
 	"io/ioutil"
+	"strconv"
+	"strings"
 )
 
 type ServerConfig struct {
 	BindIP        string `toml:"bind_ip"`
 	BindPort      int    `toml:"bind_port"`
 	UserTokenFile string `toml:"user_token_file"`
-	AuthTimeout   int64  `toml:"auth_timeout"`
-	PingTimeout   int    `toml:"ping_timeout"`
+	//每个用户可以注册的端口、域名和代理类型，为空时不限制
+	UserPolicyFile string `toml:"user_policy_file"`
+	AuthTimeout    int64  `toml:"auth_timeout"`
+	AuthLegacyMd5  bool   `toml:"auth_legacy_md5"` //是否接受旧版本客户端使用的MD5签名登录
+	PingTimeout    int    `toml:"ping_timeout"`
+
+	//允许客户端使用的远程端口，例如 "2000-3000,4000"，为空时不限制
+	AllowPorts string `toml:"allow_ports"`
+
+	//tls_trusted_ca_file不为空时校验客户端证书，tls_only为false时仍接受明文连接
+	TlsEnable        bool   `toml:"tls_enable"`
+	TlsOnly          bool   `toml:"tls_only"`
+	TlsCertFile      string `toml:"tls_cert_file"`
+	TlsKeyFile       string `toml:"tls_key_file"`
+	TlsTrustedCaFile string `toml:"tls_trusted_ca_file"`
+
+	//管理接口，为空时不开启；需要配置用户名密码或token中的至少一种
+	AdminAddr  string `toml:"admin_addr"`
+	AdminUser  string `toml:"admin_user"`
+	AdminPwd   string `toml:"admin_pwd"`
+	AdminToken string `toml:"admin_token"`
 
 	HttpProxy  *HttpProxyConf  `toml:"http_proxy"`
 	HttpsProxy *HttpsProxyConf `toml:"https_proxy"`
+
+	//配置文件路径，重新加载配置时使用
+	ConfigFile string `toml:"-"`
 }
 
 //服务端proxy的配置
 type HttpProxyConf struct {
 	VisitIP   string `toml:"visit_ip"`
 	VisitPort int    `toml:"visit_port"`
+	//客户端配置subdomain = "foo"时使用的域名为 foo.<subdomain_host>
+	SubdomainHost string `toml:"subdomain_host"`
+	//每个代理保持的空闲工作连接数(默认16，小于0时不复用)和空闲超时秒数(默认60)
+	MaxIdleConns int `toml:"max_idle_conns"`
+	IdleTimeout  int `toml:"idle_timeout"`
+	//为true时保留请求中已有的X-Forwarded-*和Forwarded头部并在其后追加，否则先删除再设置
+	TrustForwardedHeaders bool `toml:"trust_forwarded_headers"`
 }
 
 type HttpsProxyConf struct {
@@ -34,6 +66,57 @@ func NewServerConfWithFile(file_name string) (server_conf *ServerConfig, err err
 	}
 
 	server_conf = new(ServerConfig)
-	_, err = toml.Decode(string(data), server_conf)
+	if _, err = toml.Decode(string(data), server_conf); err != nil {
+		return nil, err
+	}
+	server_conf.ConfigFile = file_name
+	return
+}
+
+type PortRange struct {
+	Min int
+	Max int
+}
+
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Min && port <= r.Max
+}
+
+//解析 "2000-3000,4000" 格式的端口范围
+func ParsePortRanges(s string) (ranges []PortRange, err error) {
+	ranges = make([]PortRange, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		r := PortRange{}
+		bounds := strings.SplitN(item, "-", 2)
+		if r.Min, err = parsePort(bounds[0]); err != nil {
+			return nil, err
+		}
+		r.Max = r.Min
+		if len(bounds) == 2 {
+			if r.Max, err = parsePort(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		if r.Min > r.Max {
+			return nil, fmt.Errorf("invalid port range: %s", item)
+		}
+		ranges = append(ranges, r)
+	}
+	return
+}
+
+func parsePort(s string) (port int, err error) {
+	port, err = strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	if port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("port out of range: %d", port)
+	}
 	return
 }
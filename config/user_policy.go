@@ -0,0 +1,110 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+//所有用户的默认策略
+const DefaultPolicyUser = "*"
+
+//用户可以注册的代理，为空的项不做限制
+type UserPolicy struct {
+	//例如 "6000-6100,7000"，同时受服务器allow_ports的限制
+	AllowPorts string `json:"allow_ports"`
+	//"www.example.com"只匹配该域名，"*.team-a.example.com"匹配它的所有子域名
+	AllowDomains []string `json:"allow_domains"`
+	//"tcp"、"udp"、"http"、"https"
+	AllowTypes []string `json:"allow_types"`
+	//该用户所有客户端的代理总数，0表示不限制
+	MaxProxies int `json:"max_proxies"`
+
+	portRanges []PortRange
+}
+
+//map[user]policy
+type UserPolicyMap map[string]*UserPolicy
+
+func (u *UserPolicyMap) ReadUserPolicyMap(file_name string) (err error) {
+	data, err := ioutil.ReadFile(file_name)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, u); err != nil {
+		return err
+	}
+	for user, p := range *u {
+		if p == nil {
+			return fmt.Errorf("policy of user [%s] is empty", user)
+		}
+		if p.portRanges, err = ParsePortRanges(p.AllowPorts); err != nil {
+			return fmt.Errorf("policy of user [%s]: %v", user, err)
+		}
+	}
+	return
+}
+
+//没有单独配置的用户使用默认策略，都没有时返回nil
+func (u UserPolicyMap) Get(user string) *UserPolicy {
+	if p, ok := u[user]; ok {
+		return p
+	}
+	return u[DefaultPolicyUser]
+}
+
+func (p *UserPolicy) PortRanges() []PortRange {
+	if p == nil {
+		return nil
+	}
+	return p.portRanges
+}
+
+func (p *UserPolicy) AllowPort(port int) bool {
+	if p == nil || len(p.portRanges) == 0 {
+		return true
+	}
+	for _, r := range p.portRanges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *UserPolicy) AllowType(proxyType string) bool {
+	if p == nil || len(p.AllowTypes) == 0 {
+		return true
+	}
+	for _, t := range p.AllowTypes {
+		if strings.EqualFold(t, proxyType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *UserPolicy) AllowDomain(domain string) bool {
+	if p == nil || len(p.AllowDomains) == 0 {
+		return true
+	}
+	domain = strings.ToLower(domain)
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+
+	for _, allow := range p.AllowDomains {
+		allow = strings.ToLower(allow)
+		if strings.HasPrefix(allow, "*.") {
+			if strings.HasSuffix(domain, allow[1:]) && len(domain) > len(allow)-1 {
+				return true
+			}
+		} else if domain == allow {
+			return true
+		}
+	}
+	return false
+}
@@ -2,13 +2,23 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"proxy/utils"
 )
 
-//type User struct {
-//	UserTokenMap map[string]string
-//}
+const (
+	//获取用户token文件锁的超时时间，超过userTokenLockStale没有释放的锁视为进程异常退出后遗留
+	userTokenLockTimeout = 10 * time.Second
+	userTokenLockStale   = 30 * time.Second
+)
 
+//map[user]token，token可以是明文，也可以是utils.HashToken生成的校验值
 type UserTokenMap map[string]string
 
 func (u *UserTokenMap) ReadUserTokenMap(file_name string) (err error) {
@@ -17,22 +27,140 @@ func (u *UserTokenMap) ReadUserTokenMap(file_name string) (err error) {
 		return err
 	}
 
-	//var temp map[string]string
 	err = json.Unmarshal(data, u)
-
 	return
+}
+
+//在文件锁的保护下读取、修改并写回用户token文件，fn返回错误时不写入文件。
+//命令行工具和服务器的管理接口都通过它修改文件，文件不存在时从空表开始
+func UpdateUserTokenFile(file_name string, fn func(u UserTokenMap) error) (err error) {
+	unlock, err := lockUserTokenFile(file_name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	u := make(UserTokenMap)
+	if err = u.ReadUserTokenMap(file_name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = fn(u); err != nil {
+		return err
+	}
+	return u.WriteUserTokenMap(file_name)
+}
 
+//使用O_EXCL创建 <file>.lock 作为跨进程的锁
+func lockUserTokenFile(file_name string) (unlock func(), err error) {
+	lockFile := file_name + ".lock"
+	deadline := time.Now().Add(userTokenLockTimeout)
+	for {
+		f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockFile) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if fi, err := os.Stat(lockFile); err == nil && time.Since(fi.ModTime()) > userTokenLockStale {
+			os.Remove(lockFile)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("user token file is locked by another process, remove %s if no other process is running", lockFile)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
 }
 
+//先写入临时文件再重命名，避免写入中途出错时破坏原文件
 func (u *UserTokenMap) WriteUserTokenMap(file_name string) (err error) {
-	data, err := json.Marshal(u)
+	data, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(file_name), filepath.Base(file_name)+".tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file_name)
+}
+
+//返回登录时使用的密钥，保存的是校验值时salt不为空，key为hex编码的storedKey
+func (u UserTokenMap) Lookup(user string) (key, salt string, ok bool) {
+	token, ok := u[user]
+	if !ok {
+		return "", "", false
+	}
+	if salt, key, hashed := utils.ParseTokenHash(token); hashed {
+		return key, salt, true
+	}
+	return token, "", true
+}
+
+func (u UserTokenMap) Users() []string {
+	users := make([]string, 0, len(u))
+	for user := range u {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
 
-	backup, _ := ioutil.ReadFile(file_name)
-	ioutil.WriteFile(file_name+".backup", backup, 0661)
+//添加用户，返回生成的明文token，文件中只保存校验值
+func (u UserTokenMap) AddUser(user string) (token string, err error) {
+	if user == "" {
+		return "", fmt.Errorf("user name is empty")
+	}
+	if _, ok := u[user]; ok {
+		return "", fmt.Errorf("user [%s] already exists", user)
+	}
+	return u.setToken(user)
+}
+
+func (u UserTokenMap) DelUser(user string) error {
+	if _, ok := u[user]; !ok {
+		return fmt.Errorf("user [%s] does not exist", user)
+	}
+	delete(u, user)
+	return nil
+}
 
-	err = ioutil.WriteFile(file_name, data, 0661)
+//为已有用户生成新的token，旧token立即失效
+func (u UserTokenMap) RotateUser(user string) (token string, err error) {
+	if _, ok := u[user]; !ok {
+		return "", fmt.Errorf("user [%s] does not exist", user)
+	}
+	return u.setToken(user)
+}
+
+func (u UserTokenMap) setToken(user string) (token string, err error) {
+	if token, err = utils.GenerateToken(); err != nil {
+		return
+	}
+	hash, err := utils.HashToken(token)
+	if err != nil {
+		return "", err
+	}
+	u[user] = hash
 	return
 }
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTokenFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "proxy-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "usertoken.json")
+}
+
+//并发修改时每次修改都基于上一次写入的内容，不会丢失
+func TestUpdateUserTokenFileConcurrent(t *testing.T) {
+	file := newTokenFile(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := UpdateUserTokenFile(file, func(u UserTokenMap) error {
+				u[fmt.Sprintf("user%d", i)] = "token"
+				//读写之间让出调度，没有锁时其他修改会被覆盖
+				time.Sleep(time.Millisecond)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	u := make(UserTokenMap)
+	if err := u.ReadUserTokenMap(file); err != nil {
+		t.Fatal(err)
+	}
+	if len(u) != 20 {
+		t.Fatalf("%d users in file, want 20", len(u))
+	}
+	if _, err := os.Stat(file + ".lock"); !os.IsNotExist(err) {
+		t.Fatal("lock file is not removed")
+	}
+}
+
+func TestUpdateUserTokenFileStaleLock(t *testing.T) {
+	file := newTokenFile(t)
+	if err := ioutil.WriteFile(file+".lock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * userTokenLockStale)
+	os.Chtimes(file+".lock", old, old)
+
+	err := UpdateUserTokenFile(file, func(u UserTokenMap) error {
+		_, err := u.AddUser("test")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateUserTokenFileError(t *testing.T) {
+	file := newTokenFile(t)
+	if err := ioutil.WriteFile(file, []byte(`{"test": "123456"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := UpdateUserTokenFile(file, func(u UserTokenMap) error {
+		delete(u, "test")
+		return u.DelUser("nobody")
+	})
+	if err == nil {
+		t.Fatal("update succeeded")
+	}
+	u := make(UserTokenMap)
+	if err := u.ReadUserTokenMap(file); err != nil || u["test"] != "123456" {
+		t.Fatal("file is modified after failed update:", u, err)
+	}
+}
@@ -1,6 +1,6 @@
 package message
 
-//import "fmt"
+import "fmt"
 
 const (
 	TypeLogin        = '1'
@@ -12,6 +12,17 @@ const (
 	TypePing         = '4'
 	TypePong         = 'd'
 	TypeStartWork    = 'e'
+	TypeUdpPacket    = '5'
+
+	TypeLoginChallenge = 'f'
+	TypeLoginAuth      = '6'
+
+	TypeCloseProxy = '7'
+)
+
+const (
+	//Login.AuthMethod为空时使用旧的MD5签名，服务器需要开启auth_legacy_md5
+	AuthMethodHmac = "hmac"
 )
 
 //var AllType = [...]string{TypeLogin, TypeLoginResp, TypeNewProxy, TypeNewProxyResp, TypePing, TypePong}
@@ -29,6 +40,24 @@ type Login struct {
 	ClientId      string `json:"client_id"`
 	ConnPoolCount int    `json:"conn_pool_count"`
 	Timestamp     int64  `json:"timestamp"`
+	AuthMethod    string `json:"auth_method"`
+}
+
+//hmac签名的内容，客户端和服务器必须保持一致
+func (l *Login) HmacSignData(nonce string) string {
+	return fmt.Sprintf("%s|%s|%s|%d", nonce, l.User, l.ClientId, l.Timestamp)
+}
+
+//使用hmac认证时，服务器收到Login消息后返回一次性的随机数
+type LoginChallenge struct {
+	Nonce string `json:"nonce"`
+	Salt  string `json:"salt,omitempty"` //服务器只保存token的校验值时不为空
+}
+
+//客户端使用token对随机数、用户名和时间戳计算HMAC-SHA256，
+//Salt不为空时Sign为utils.TokenProof计算的登录证明
+type LoginAuth struct {
+	Sign string `json:"sign"`
 }
 
 //服务器收到客户端的Login消息后，会返回LoginResp消息
@@ -39,14 +68,37 @@ type LoginResp struct {
 }
 
 type NewProxy struct {
-	ProxyName  string `json:"proxy_name"`
-	ProxyType  string `json:"proxy_type"`
-	RemotePort int    `json:"remote_port"` //指定服务器向外的代理接口
-	Encrypt    bool   `json:"encrypt"`     //传输是否加密
+	ProxyName     string `json:"proxy_name"`
+	ProxyType     string `json:"proxy_type"`
+	RemotePort    int    `json:"remote_port"`    //指定服务器向外的代理接口
+	Encrypt       bool   `json:"encrypt"`        //传输是否加密
+	EncryptMethod string `json:"encrypt_method"` //为空时使用AES-CFB
+	Compression   string `json:"compression"`    //"snappy"、"gzip"或"none"
+
+	Host      string `json:"host"`
+	Domain    string `json:"domain"` //可以是 *.example.com 形式的泛域名
+	Url       string `json:"url"`
+	Subdomain string `json:"subdomain"`
+
+	//相同group的代理共享路由或端口，group_key一致才能加入
+	Group       string `json:"group"`
+	GroupKey    string `json:"group_key"`
+	Weight      int    `json:"weight"`
+	LoadBalance string `json:"load_balance"` //"round_robin"(默认)、"weighted"或"ip_hash"
+
+	//http代理的头部和路径改写
+	HostHeaderRewrite     string            `json:"host_header_rewrite"`
+	RequestHeaders        map[string]string `json:"request_headers"`
+	RemoveRequestHeaders  []string          `json:"remove_request_headers"`
+	ResponseHeaders       map[string]string `json:"response_headers"`
+	RemoveResponseHeaders []string          `json:"remove_response_headers"`
+	RewritePath           string            `json:"rewrite_path"`
 
-	Host   string `json:"host"`
-	Domain string `json:"domain"`
-	Url    string `json:"url"`
+	//http代理的访问控制
+	HttpUser string   `json:"http_user"`
+	HttpPwd  string   `json:"http_pwd"`
+	AllowIPs []string `json:"allow_ips"`
+	DenyIPs  []string `json:"deny_ips"`
 }
 
 type NewProxyResp struct {
@@ -55,6 +107,11 @@ type NewProxyResp struct {
 	Error      string `json:"error"`
 }
 
+//客户端删除或修改代理配置后，通知服务器关闭对应的代理
+type CloseProxy struct {
+	ProxyName string `json:"proxy_name"`
+}
+
 type ReqWorkConn struct {
 }
 
@@ -70,4 +127,13 @@ type Pong struct {
 
 type StartWork struct {
 	ProxyName string `json:"proxy_name"`
+	//tcp和https代理中访问者的地址和服务器上被访问的地址，用于PROXY protocol
+	SrcAddr string `json:"src_addr,omitempty"`
+	DstAddr string `json:"dst_addr,omitempty"`
+}
+
+//udp代理中，服务器与客户端之间通过工作连接传输的数据包
+type UdpPacket struct {
+	Content    []byte `json:"content"`
+	RemoteAddr string `json:"remote_addr"` //访问者的地址，客户端回复时原样带回
 }
@@ -43,6 +43,14 @@ func UnPack(m Message) (msg_type byte, msg interface{}, err error) {
 		msg = new(ReqWorkConn)
 	case TypeStartWork:
 		msg = new(StartWork)
+	case TypeUdpPacket:
+		msg = new(UdpPacket)
+	case TypeLoginChallenge:
+		msg = new(LoginChallenge)
+	case TypeLoginAuth:
+		msg = new(LoginAuth)
+	case TypeCloseProxy:
+		msg = new(CloseProxy)
 	}
 	err = json.Unmarshal([]byte(m.MesData), msg)
 	msg_type = m.Type
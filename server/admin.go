@@ -0,0 +1,308 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"proxy/config"
+	"proxy/utils"
+)
+
+//服务器管理接口
+//
+//GET    /api/clients                       所有客户端及其代理
+//DELETE /api/clients/{clientId}            断开客户端
+//GET    /api/proxies                       所有代理
+//DELETE /api/clients/{clientId}/proxies/{name}  关闭单个代理
+//GET    /api/routers                       http路由表
+//POST   /api/reload                        重新加载配置文件和用户token文件
+//GET    /api/users                         所有用户
+//POST   /api/users/{name}                  添加用户，返回生成的token
+//DELETE /api/users/{name}                  删除用户并断开其客户端
+//POST   /api/users/{name}/rotate           重新生成用户的token
+type AdminServer struct {
+	svr *Service
+	mux *http.ServeMux
+}
+
+type ClientInfo struct {
+	ClientId  string      `json:"client_id"`
+	User      string      `json:"user"`
+	Hostname  string      `json:"hostname"`
+	Addr      string      `json:"addr"`
+	LoginTime time.Time   `json:"login_time"`
+	LastPing  time.Time   `json:"last_ping"`
+	Proxies   []ProxyInfo `json:"proxies"`
+}
+
+type ProxyInfo struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	ClientId   string `json:"client_id"`
+	User       string `json:"user"`
+	RemotePort int    `json:"remote_port,omitempty"`
+	Domain     string `json:"domain,omitempty"`
+	Url        string `json:"url,omitempty"`
+	Group      string `json:"group,omitempty"`
+	Status     string `json:"status"`
+	//http代理的请求数和被拒绝的请求数
+	Http *HttpStats `json:"http,omitempty"`
+}
+
+func NewAdminServer(svr *Service) (as *AdminServer, err error) {
+	if err = checkAdminAuth(svr.conf); err != nil {
+		return nil, err
+	}
+
+	as = &AdminServer{
+		svr: svr,
+		mux: http.NewServeMux(),
+	}
+	as.mux.HandleFunc("/api/clients", as.handleClients)
+	as.mux.HandleFunc("/api/clients/", as.handleClient)
+	as.mux.HandleFunc("/api/proxies", as.handleProxies)
+	as.mux.HandleFunc("/api/routers", as.handleRouters)
+	as.mux.HandleFunc("/api/reload", as.handleReload)
+	as.mux.HandleFunc("/api/users", as.handleUsers)
+	as.mux.HandleFunc("/api/users/", as.handleUser)
+	return
+}
+
+func (as *AdminServer) Run(l net.Listener) {
+	server := &http.Server{
+		Handler:     as,
+		ReadTimeout: ReadTimeout,
+	}
+	if err := server.Serve(l); err != nil {
+		log.Warn("admin server exit:", err)
+	}
+}
+
+func (as *AdminServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !as.authorized(req) {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="proxy admin"`)
+		utils.WriteError(rw, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	as.mux.ServeHTTP(rw, req)
+}
+
+func (as *AdminServer) authorized(req *http.Request) bool {
+	conf := as.svr.getConf()
+
+	if conf.AdminToken != "" {
+		auth := req.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && utils.SecureEqual(strings.TrimPrefix(auth, "Bearer "), conf.AdminToken) {
+			return true
+		}
+	}
+
+	if conf.AdminUser != "" && conf.AdminPwd != "" {
+		user, pwd, ok := req.BasicAuth()
+		if ok && utils.SecureEqual(user, conf.AdminUser) && utils.SecureEqual(pwd, conf.AdminPwd) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkAdminAuth(conf *config.ServerConfig) error {
+	if conf.AdminToken == "" && (conf.AdminUser == "" || conf.AdminPwd == "") {
+		return fmt.Errorf("admin_addr is set, but neither admin_token nor admin_user/admin_pwd is configured")
+	}
+	return nil
+}
+
+func (as *AdminServer) handleClients(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		utils.WriteError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	clients := as.svr.clientManager.List()
+	list := make([]ClientInfo, 0, len(clients))
+	for _, c := range clients {
+		list = append(list, getClientInfo(c))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LoginTime.Before(list[j].LoginTime)
+	})
+	utils.WriteJson(rw, http.StatusOK, list)
+}
+
+//处理 /api/clients/{clientId} 和 /api/clients/{clientId}/proxies/{name}
+func (as *AdminServer) handleClient(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/clients/"), "/"), "/")
+
+	c, ok := as.svr.clientManager.Get(parts[0])
+	if !ok {
+		utils.WriteError(rw, http.StatusNotFound, "client not found")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && req.Method == http.MethodGet:
+		utils.WriteJson(rw, http.StatusOK, getClientInfo(c))
+
+	case len(parts) == 1 && req.Method == http.MethodDelete:
+		log.Info("admin kick client [", c.clientId, "]")
+		c.Close()
+		utils.WriteJson(rw, http.StatusOK, map[string]string{"result": "ok"})
+
+	case len(parts) == 3 && parts[1] == "proxies" && req.Method == http.MethodDelete:
+		if err := c.CloseProxy(parts[2]); err != nil {
+			utils.WriteError(rw, http.StatusNotFound, err.Error())
+			return
+		}
+		utils.WriteJson(rw, http.StatusOK, map[string]string{"result": "ok"})
+
+	default:
+		utils.WriteError(rw, http.StatusNotFound, "not found")
+	}
+}
+
+func (as *AdminServer) handleProxies(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		utils.WriteError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	list := make([]ProxyInfo, 0)
+	for _, c := range as.svr.clientManager.List() {
+		list = append(list, getProxyInfos(c)...)
+	}
+	utils.WriteJson(rw, http.StatusOK, list)
+}
+
+func (as *AdminServer) handleRouters(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		utils.WriteError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	list := make([]RouterInfo, 0)
+	if as.svr.httpReverseProxy != nil {
+		list = as.svr.httpReverseProxy.router.List()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Domain != list[j].Domain {
+			return list[i].Domain < list[j].Domain
+		}
+		return list[i].Url < list[j].Url
+	})
+	utils.WriteJson(rw, http.StatusOK, list)
+}
+
+func (as *AdminServer) handleReload(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		utils.WriteError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	kicked, err := as.svr.Reload()
+	if err != nil {
+		utils.WriteError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	utils.WriteJson(rw, http.StatusOK, map[string]interface{}{
+		"result":         "ok",
+		"kicked_clients": kicked,
+	})
+}
+
+func (as *AdminServer) handleUsers(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		utils.WriteError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	as.svr.mu.RLock()
+	users := as.svr.userToken.Users()
+	as.svr.mu.RUnlock()
+	utils.WriteJson(rw, http.StatusOK, users)
+}
+
+//处理 /api/users/{name} 和 /api/users/{name}/rotate
+func (as *AdminServer) handleUser(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/users/"), "/"), "/")
+	user := parts[0]
+
+	var token string
+	var err error
+	switch {
+	case len(parts) == 1 && req.Method == http.MethodPost:
+		err = as.svr.updateUserTokenMap(func(u config.UserTokenMap) (err error) {
+			token, err = u.AddUser(user)
+			return
+		})
+	case len(parts) == 1 && req.Method == http.MethodDelete:
+		err = as.svr.updateUserTokenMap(func(u config.UserTokenMap) error {
+			return u.DelUser(user)
+		})
+	case len(parts) == 2 && parts[1] == "rotate" && req.Method == http.MethodPost:
+		err = as.svr.updateUserTokenMap(func(u config.UserTokenMap) (err error) {
+			token, err = u.RotateUser(user)
+			return
+		})
+	default:
+		utils.WriteError(rw, http.StatusNotFound, "not found")
+		return
+	}
+
+	if err != nil {
+		utils.WriteError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Info("admin update user [", user, "]")
+
+	resp := map[string]string{"result": "ok", "user": user}
+	if token != "" {
+		resp["token"] = token
+	}
+	utils.WriteJson(rw, http.StatusOK, resp)
+}
+
+func getClientInfo(c *ClientCtrl) ClientInfo {
+	return ClientInfo{
+		ClientId:  c.clientId,
+		User:      c.loginMsg.User,
+		Hostname:  c.loginMsg.Hostname,
+		Addr:      c.conn.RemoteAddr().String(),
+		LoginTime: c.loginTime,
+		LastPing:  c.GetLastPing(),
+		Proxies:   getProxyInfos(c),
+	}
+}
+
+func getProxyInfos(c *ClientCtrl) []ProxyInfo {
+	proxies := c.GetProxies()
+	list := make([]ProxyInfo, 0, len(proxies))
+	for _, p := range proxies {
+		m := p.GetMsg()
+		info := ProxyInfo{
+			Name:       p.GetName(),
+			Type:       p.GetType(),
+			ClientId:   c.clientId,
+			User:       c.loginMsg.User,
+			RemotePort: m.RemotePort,
+			Domain:     m.Domain,
+			Url:        m.Url,
+			Group:      m.Group,
+			Status:     "running",
+		}
+		if hp, ok := p.(*HttpProxy); ok {
+			stats := hp.GetHttpStats()
+			info.Http = &stats
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
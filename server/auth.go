@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	msg "proxy/message"
+	"proxy/utils"
+)
+
+const (
+	//auth_timeout为0时，签名缓存的默认有效期
+	defaultAuthTimeout int64 = 600
+)
+
+//记录最近使用过的签名，拒绝重放的登录请求
+type SignCache struct {
+	//map[sign]expireTime
+	signs     map[string]time.Time
+	lastPurge time.Time
+
+	mu sync.Mutex
+}
+
+func NewSignCache() *SignCache {
+	return &SignCache{
+		signs:     make(map[string]time.Time),
+		lastPurge: time.Now(),
+	}
+}
+
+//签名未出现过时记录并返回true，重复出现时返回false
+func (sc *SignCache) Add(sign string, ttl time.Duration) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(sc.lastPurge) > time.Minute {
+		for s, expire := range sc.signs {
+			if now.After(expire) {
+				delete(sc.signs, s)
+			}
+		}
+		sc.lastPurge = now
+	}
+
+	if expire, ok := sc.signs[sign]; ok && now.Before(expire) {
+		return false
+	}
+	sc.signs[sign] = now.Add(ttl)
+	return true
+}
+
+func (svr *Service) authTimeout() int64 {
+	conf := svr.getConf()
+	if conf.AuthTimeout <= 0 {
+		return defaultAuthTimeout
+	}
+	return conf.AuthTimeout
+}
+
+//校验登录请求，成功时返回本次连接使用的密钥：明文token或者由登录证明得到的会话密钥
+func (svr *Service) authenticate(conn net.Conn, loginMsg *msg.Login) (token string, err error) {
+	now := time.Now().Unix()
+	timeout := svr.authTimeout()
+	if now-loginMsg.Timestamp > timeout || loginMsg.Timestamp-now > timeout {
+		err = fmt.Errorf("Authorization Error: Timeout")
+		return
+	}
+
+	token, salt, ok := svr.getUserToken(loginMsg.User)
+	if !ok {
+		err = fmt.Errorf("Authorization Error: This user does not exist")
+		return
+	}
+
+	switch loginMsg.AuthMethod {
+	case msg.AuthMethodHmac:
+		token, err = svr.authHmac(conn, loginMsg, token, salt)
+	case "":
+		if salt != "" {
+			err = fmt.Errorf("Authorization Error: MD5 login is not supported for hashed tokens, please upgrade the client")
+			return
+		}
+		err = svr.authLegacyMd5(loginMsg, token)
+	default:
+		err = fmt.Errorf("Authorization Error: unsupported auth method %s", loginMsg.AuthMethod)
+	}
+	return
+}
+
+//salt不为空时token为hex编码的storedKey，客户端发送登录证明而不是签名
+func (svr *Service) authHmac(conn net.Conn, loginMsg *msg.Login, token, salt string) (key string, err error) {
+	nonce, err := utils.GetNonce()
+	if err != nil {
+		return
+	}
+
+	err = msg.WriteMsg(msg.TypeLoginChallenge, msg.LoginChallenge{Nonce: nonce, Salt: salt}, conn)
+	if err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+	msgType, m, err := msg.ReadMsg(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	if msgType != msg.TypeLoginAuth {
+		return "", fmt.Errorf("Authorization Error: The response message is not LoginAuth")
+	}
+
+	sign := m.(*msg.LoginAuth).Sign
+	key = token
+	if salt != "" {
+		storedKey, _ := hex.DecodeString(token)
+		clientKey, ok := utils.VerifyTokenProof(storedKey, loginMsg.HmacSignData(nonce), sign)
+		if !ok {
+			return "", fmt.Errorf("Authorization Error: Token error")
+		}
+		key = utils.SessionTokenKey(clientKey, nonce)
+	} else if !utils.SignEqual(utils.GetHmacSign([]byte(token), loginMsg.HmacSignData(nonce)), sign) {
+		return "", fmt.Errorf("Authorization Error: Token error")
+	}
+	if !svr.signCache.Add(sign, time.Duration(svr.authTimeout())*time.Second) {
+		return "", fmt.Errorf("Authorization Error: Replayed login")
+	}
+	return
+}
+
+func (svr *Service) authLegacyMd5(loginMsg *msg.Login, token string) (err error) {
+	if !svr.getConf().AuthLegacyMd5 {
+		return fmt.Errorf("Authorization Error: MD5 login is disabled, please upgrade the client")
+	}
+
+	_, sign := utils.GetMD5([]byte(fmt.Sprintf("%s%d", token, loginMsg.Timestamp)))
+	if !utils.SignEqual(sign, loginMsg.Sign) {
+		return fmt.Errorf("Authorization Error: Token error")
+	}
+	if !svr.signCache.Add(sign, time.Duration(svr.authTimeout())*time.Second) {
+		return fmt.Errorf("Authorization Error: Replayed login")
+	}
+	log.Warn("user ", loginMsg.User, " login with legacy MD5 sign")
+	return
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"proxy/config"
+	"proxy/utils"
+)
+
+//服务器只保存校验值时，客户端使用明文token登录，工作连接使用会话密钥加密
+func TestHashedTokenLogin(t *testing.T) {
+	hash, err := utils.HashToken(testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := newTestService(t, func(conf *config.ServerConfig) {
+		data, _ := json.Marshal(map[string]string{testUser: hash})
+		if err := ioutil.WriteFile(conf.UserTokenFile, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	})
+	localPort := newEchoServer(t)
+	newTestClient(t, svr, nil, &config.ProxyConf{
+		Name:       "echo",
+		Type:       "tcp",
+		Encryption: true,
+		LocalIP:    "127.0.0.1",
+		LocalPort:  localPort,
+	})
+
+	ctrl := waitProxies(t, svr, 1)
+	if ctrl.token == hash || ctrl.token == testToken {
+		t.Fatal("session key is not derived from the login proof")
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", getProxy(t, ctrl, "echo").GetMsg().RemotePort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoRoundTrip(t, conn, []byte("hashed token"))
+}
+
+//文件中的校验值不能代替token登录
+func TestStoredHashCanNotLogin(t *testing.T) {
+	hash, err := utils.HashToken(testToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, stored, _ := utils.ParseTokenHash(hash)
+	svr := newTestService(t, func(conf *config.ServerConfig) {
+		data, _ := json.Marshal(map[string]string{testUser: hash})
+		if err := ioutil.WriteFile(conf.UserTokenFile, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, token := range []string{hash, stored} {
+		newTestClient(t, svr, func(conf *config.ClientConfig) {
+			conf.Token = token
+		})
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n := len(svr.clientManager.List()); n != 0 {
+		t.Fatalf("%d clients login with the stored hash", n)
+	}
+}
@@ -15,6 +15,8 @@ import (
 type ClientCtrl struct {
 	svr  *Service
 	conn net.Conn
+	//控制连接所在的多路复用会话，非多路复用时为nil
+	session *utils.Session
 
 	loginMsg *msg.Login
 	clientId string
@@ -25,10 +27,13 @@ type ClientCtrl struct {
 	receiveCh chan (msg.Message)
 
 	connPool chan (net.Conn)
-	closed   chan int
+	//Close时关闭，通知所有goroutine退出
+	done   chan struct{}
+	closed bool
 
-	lastPing time.Time
-	mu       sync.RWMutex
+	loginTime time.Time
+	lastPing  time.Time
+	mu        sync.RWMutex
 }
 
 func NewClientCtrl(svr *Service, loginMsg *msg.Login, conn net.Conn, token string) (client *ClientCtrl) {
@@ -42,7 +47,8 @@ func NewClientCtrl(svr *Service, loginMsg *msg.Login, conn net.Conn, token strin
 		sendCh:    make(chan msg.Message, 10),
 		receiveCh: make(chan msg.Message, 10),
 		connPool:  make(chan net.Conn, loginMsg.ConnPoolCount+10),
-		closed:    make(chan int),
+		done:      make(chan struct{}),
+		loginTime: time.Now(),
 		lastPing:  time.Now(),
 	}
 	return
@@ -57,6 +63,7 @@ func (c *ClientCtrl) Start() {
 
 	if err := msg.WriteMsg(msg.TypeLoginResp, loginResp, c.conn); err != nil {
 		log.Error(err)
+		c.Close()
 		return
 	}
 
@@ -69,30 +76,29 @@ func (c *ClientCtrl) Start() {
 }
 
 func (c *ClientCtrl) manager() {
+	defer c.Close()
+
 	go c.readMsg()
 	go c.writeMsg()
 
 	pingCheck := time.NewTicker(time.Second)
 	defer pingCheck.Stop()
-	c.lastPing = time.Now()
+	c.setLastPing()
 	for {
 		select {
 		case <-pingCheck.C:
-			if time.Since(c.lastPing) > time.Duration(c.svr.conf.PingTimeout)*time.Second {
+			if time.Since(c.GetLastPing()) > time.Duration(c.svr.getConf().PingTimeout)*time.Second {
 				log.Error("client ping timeout")
-				c.conn.Close()
 				return
 			}
 
 		case rawMsg, ok := <-c.receiveCh:
 			if !ok {
-				c.conn.Close()
 				return
 			}
 			msg_type, m, err := msg.UnPack(rawMsg)
 			if err != nil {
 				log.Error(err)
-				c.conn.Close()
 				return
 			}
 			switch msg_type {
@@ -100,8 +106,13 @@ func (c *ClientCtrl) manager() {
 				log.Debug("NewProxy")
 				newProxy := m.(*msg.NewProxy)
 				c.RegisterProxy(*newProxy)
+			case msg.TypeCloseProxy:
+				closeProxy := m.(*msg.CloseProxy)
+				if err := c.CloseProxy(closeProxy.ProxyName); err != nil {
+					log.Warn("close proxy error:", err)
+				}
 			case msg.TypePing:
-				c.lastPing = time.Now()
+				c.setLastPing()
 				log.Debug("receive ping msg from client:", c.clientId)
 				pong := msg.Pong{}
 				m, err := msg.Pack(msg.TypePong, pong)
@@ -109,10 +120,10 @@ func (c *ClientCtrl) manager() {
 					log.Error(err)
 					continue
 				}
-				c.sendCh <- m
+				c.sendMsg(m)
 			}
 
-		case <-c.closed:
+		case <-c.done:
 			log.Debug("client is exited")
 			return
 		}
@@ -121,21 +132,23 @@ func (c *ClientCtrl) manager() {
 }
 
 func (c *ClientCtrl) readMsg() {
+	defer close(c.receiveCh)
 	conn := utils.NewReader(c.conn, []byte(c.token))
 
 	for {
 		if m, err := msg.ReadRawMsg(conn); err != nil {
 			if err == io.EOF {
 				log.Debug("read message from client EOF")
-				c.closed <- 1
-				return
-
 			} else {
 				log.Error(err)
-				return
 			}
+			return
 		} else {
-			c.receiveCh <- m
+			select {
+			case c.receiveCh <- m:
+			case <-c.done:
+				return
+			}
 		}
 
 	}
@@ -143,71 +156,75 @@ func (c *ClientCtrl) readMsg() {
 }
 
 func (c *ClientCtrl) writeMsg() {
+	defer c.Close()
 	conn, err := utils.NewWriter(c.conn, []byte(c.token))
 	if err != nil {
 		log.Error(err)
-		c.conn.Close()
 		return
 	}
 
 	for {
-		if m, ok := <-c.sendCh; !ok {
-			log.Error("send message chan closed")
-			return
-		} else {
+		select {
+		case m := <-c.sendCh:
 			if err := msg.WriteRawMsg(m, conn); err != nil {
 				log.Error(err)
 				return
 			}
-
+		case <-c.done:
+			return
 		}
 
 	}
 
 }
 
+//客户端已断开时返回false
+func (c *ClientCtrl) sendMsg(m msg.Message) bool {
+	select {
+	case c.sendCh <- m:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
 func (c *ClientCtrl) NewWorkConn(conn net.Conn) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Error("register work connection error:", err)
-		}
-	}()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		log.Info("receive work connection,but client is closed.[ClientId]:", c.clientId)
+		conn.Close()
+		return
+	}
 
 	select {
 	case c.connPool <- conn:
 		log.Info("Add new work connection to ConnPool.[ClientId]:", c.clientId)
 	default:
 		log.Info("Add new wockConn failed,ConnPool is full.[ClientId]:", c.clientId)
-		c.Close()
+		conn.Close()
 	}
 
 }
 
 func (c *ClientCtrl) GetWorkConn() (conn net.Conn, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Error(r)
-		}
-	}()
-
-	var ok bool
 	select {
-	case conn, ok = <-c.connPool:
-		if !ok {
-			err = fmt.Errorf("connPool is closed")
-			return
-		}
+	case conn = <-c.connPool:
 		log.Debug("get conn from pool")
+	case <-c.done:
+		err = fmt.Errorf("client is closed")
+		return
 	default:
 		c.ReqNewWorkConn()
 		select {
-		case conn, ok = <-c.connPool:
-			if !ok {
-				err = fmt.Errorf("connPool is closed")
-				return
-			}
+		case conn = <-c.connPool:
 			log.Debug("get work connection from pool")
 
+		case <-c.done:
+			err = fmt.Errorf("client is closed")
+			return
+
 		case <-time.After(time.Duration(10) * time.Second):
 			err = fmt.Errorf("get new work connection timeout")
 			log.Warn(err)
@@ -233,7 +250,7 @@ func (c *ClientCtrl) ReqNewWorkConn() {
 		return
 	}
 	log.Debug("send newworkconn msg")
-	c.sendCh <- M
+	c.sendMsg(M)
 
 	return
 
@@ -246,30 +263,141 @@ func (c *ClientCtrl) RegisterProxy(m msg.NewProxy) {
 		}
 	}()
 
-	pxy := NewProxy(c, m)
-
-	pxy.Run()
-
-	c.mu.Lock()
-	c.proxies[pxy.GetName()] = pxy
-	c.mu.Unlock()
-
 	resp := msg.NewProxyResp{
-		ProxyName: pxy.GetName(),
+		ProxyName:  m.ProxyName,
+		RemotePort: m.RemotePort,
+	}
+
+	pxy, closed, err := c.addProxy(m)
+	if err != nil {
+		log.Error("register proxy [", m.ProxyName, "] error:", err)
+		resp.Error = fmt.Sprintf("%v", err)
+	} else if closed {
+		return
+	} else {
+		resp.RemotePort = pxy.GetMsg().RemotePort
 	}
 
 	M, err := msg.Pack(msg.TypeNewProxyResp, resp)
 	if err != nil {
-		pxy.Close()
 		log.Error(err)
 		return
 	}
-	c.sendCh <- M
+	c.sendMsg(M)
+}
+
+//检查并启动代理后加入代理表，客户端已关闭时关闭代理并返回closed。
+//用户限制了代理总数时整个过程持有svr.policyMu，避免并发注册超过max_proxies
+func (c *ClientCtrl) addProxy(m msg.NewProxy) (pxy Proxy, closed bool, err error) {
+	if p := c.policy(); p != nil && p.MaxProxies > 0 {
+		c.svr.policyMu.Lock()
+		defer c.svr.policyMu.Unlock()
+	}
+
+	c.mu.RLock()
+	_, exist := c.proxies[m.ProxyName]
+	c.mu.RUnlock()
+	if exist {
+		return nil, false, fmt.Errorf("proxy [%s] is already registered", m.ProxyName)
+	}
+
+	if err = c.svr.resolveDomain(&m); err != nil {
+		return
+	}
+	if err = c.checkPolicy(m); err != nil {
+		return
+	}
+	if pxy, err = NewProxy(c, m); err != nil {
+		return
+	}
+	if err = pxy.Run(); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	closed = c.closed
+	if !closed {
+		c.proxies[pxy.GetName()] = pxy
+	}
+	c.mu.Unlock()
+
+	if closed {
+		pxy.Close()
+	}
+	return
 }
 
+func (c *ClientCtrl) setLastPing() {
+	c.mu.Lock()
+	c.lastPing = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *ClientCtrl) GetLastPing() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastPing
+}
+
+func (c *ClientCtrl) GetProxies() []Proxy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	proxies := make([]Proxy, 0, len(c.proxies))
+	for _, p := range c.proxies {
+		proxies = append(proxies, p)
+	}
+	return proxies
+}
+
+//关闭单个代理
+func (c *ClientCtrl) CloseProxy(name string) error {
+	c.mu.Lock()
+	pxy, ok := c.proxies[name]
+	delete(c.proxies, name)
+	c.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("proxy [%s] not found", name)
+	}
+	pxy.Close()
+	log.Info("proxy [", name, "] of client [", c.clientId, "] is closed")
+	return nil
+}
+
+//断开客户端并释放它占用的所有资源：代理、端口、工作连接和goroutine
 func (c *ClientCtrl) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.done)
+
 	c.conn.Close()
-	for _, p := range c.proxies {
+	//控制连接是多路复用中的一个流时，关闭整个会话
+	if c.session != nil {
+		c.session.Close()
+	}
+
+	proxies := c.proxies
+	c.proxies = make(map[string]Proxy)
+
+	for {
+		select {
+		case conn := <-c.connPool:
+			conn.Close()
+			continue
+		default:
+		}
+		break
+	}
+	c.mu.Unlock()
+
+	for _, p := range proxies {
 		p.Close()
 	}
+	c.svr.clientManager.Remove(c.clientId, c)
+	log.Info("client [", c.clientId, "] is closed")
 }
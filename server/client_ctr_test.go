@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"proxy/config"
+)
+
+func newUdpEchoServer(t testing.TB) int {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func newHttpServer(t testing.TB, body string) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(body))
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func freePort(t testing.TB) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func goroutineDump() string {
+	buf := make([]byte, 1<<20)
+	return string(buf[:runtime.Stack(buf, true)])
+}
+
+//控制连接断开后，服务器释放该客户端的代理、端口和goroutine
+func TestClientCloseReleasesResources(t *testing.T) {
+	httpPort := freePort(t)
+	svr := newTestService(t, func(conf *config.ServerConfig) {
+		conf.HttpProxy.VisitIP = "127.0.0.1"
+		conf.HttpProxy.VisitPort = httpPort
+	})
+	tcpLocal := newEchoServer(t)
+	udpLocal := newUdpEchoServer(t)
+	httpLocal := newHttpServer(t, "hello http")
+
+	time.Sleep(100 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	c := newTestClient(t, svr, nil,
+		&config.ProxyConf{Name: "tcp", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: tcpLocal},
+		&config.ProxyConf{Name: "udp", Type: "udp", LocalIP: "127.0.0.1", LocalPort: udpLocal},
+		&config.ProxyConf{Name: "web", Type: "http", LocalIP: "127.0.0.1", LocalPort: httpLocal, Domain: "leak.test"},
+	)
+	ctrl := waitProxies(t, svr, 3)
+	tcpPort := getProxy(t, ctrl, "tcp").GetMsg().RemotePort
+	udpPort := getProxy(t, ctrl, "udp").GetMsg().RemotePort
+
+	//每种代理都转发一次数据，让工作连接和相关的goroutine都运行起来
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, conn, []byte("tcp"))
+	defer conn.Close()
+
+	uconn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", udpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	buf := make([]byte, 16)
+	waitFor(t, 5*time.Second, "udp echo", func() bool {
+		uconn.Write([]byte("udp"))
+		uconn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := uconn.Read(buf)
+		return err == nil && string(buf[:n]) == "udp"
+	})
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/", httpPort), nil)
+	req.Host = "leak.test"
+	hc := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !bytes.Equal(body, []byte("hello http")) {
+		t.Fatalf("http body = %q", body)
+	}
+
+	//断开控制连接，客户端不再重连
+	c.Close()
+	waitFor(t, 5*time.Second, "client removed", func() bool {
+		_, ok := svr.clientManager.Get(ctrl.clientId)
+		return !ok
+	})
+
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: %d > %d\n%s", runtime.NumGoroutine(), baseline, goroutineDump())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if _, err := svr.portManager.Acquire("new", tcpPort, nil); err != nil {
+		t.Fatal("tcp remote port is not released:", err)
+	}
+	if _, err := svr.udpPortManager.Acquire("new", udpPort, nil); err != nil {
+		t.Fatal("udp remote port is not released:", err)
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort))
+	if err != nil {
+		t.Fatal("tcp remote port is still bound:", err)
+	}
+	l.Close()
+	pc, err := net.ListenPacket("udp", fmt.Sprintf("127.0.0.1:%d", udpPort))
+	if err != nil {
+		t.Fatal("udp remote port is still bound:", err)
+	}
+	pc.Close()
+	if svr.httpReverseProxy.GetProxy("leak.test", "/", "127.0.0.1") != nil {
+		t.Fatal("http route is not removed")
+	}
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"proxy/utils"
+)
+
+//同一分组中的代理共享一个http路由或tcp端口，由服务器在它们之间做负载均衡
+const (
+	LoadBalanceRoundRobin = "round_robin"
+	LoadBalanceWeighted   = "weighted"
+	LoadBalanceIpHash     = "ip_hash" //按访问者ip做一致性哈希
+
+	//一致性哈希中每个权重对应的虚拟节点数
+	hashReplicas = 40
+)
+
+func IsValidLoadBalance(lb string) bool {
+	switch lb {
+	case "", LoadBalanceRoundRobin, LoadBalanceWeighted, LoadBalanceIpHash:
+		return true
+	}
+	return false
+}
+
+type groupMember struct {
+	pxy     Proxy
+	weight  int
+	current int
+}
+
+type ProxyGroup struct {
+	name     string
+	key      string
+	strategy string
+
+	members []*groupMember
+	next    int
+
+	//一致性哈希环
+	ring      []uint32
+	ringNodes map[uint32]Proxy
+
+	mu sync.Mutex
+}
+
+//name为空的分组只能有一个成员
+func NewProxyGroup(name, key, strategy string) *ProxyGroup {
+	if strategy == "" {
+		strategy = LoadBalanceRoundRobin
+	}
+	return &ProxyGroup{
+		name:     name,
+		key:      key,
+		strategy: strategy,
+	}
+}
+
+func (g *ProxyGroup) Name() string {
+	return g.name
+}
+
+func (g *ProxyGroup) Strategy() string {
+	return g.strategy
+}
+
+//加入分组，group_key必须与第一个成员一致
+func (g *ProxyGroup) Join(pxy Proxy) error {
+	m := pxy.GetMsg()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.members) > 0 {
+		if g.name == "" {
+			return fmt.Errorf("proxy [%s] is not in a group", g.members[0].pxy.GetName())
+		}
+		if !utils.SecureEqual(m.GroupKey, g.key) {
+			return fmt.Errorf("group_key of group [%s] is not correct", g.name)
+		}
+		if m.LoadBalance != "" && m.LoadBalance != g.strategy {
+			return fmt.Errorf("load_balance of group [%s] is %s", g.name, g.strategy)
+		}
+	}
+
+	weight := m.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	g.members = append(g.members, &groupMember{
+		pxy:    pxy,
+		weight: weight,
+	})
+	g.buildRing()
+	if g.name != "" {
+		log.Info("proxy [", pxy.GetName(), "] join group [", g.name, "], members:", len(g.members))
+	}
+	return nil
+}
+
+//离开分组，返回分组是否已经没有成员
+func (g *ProxyGroup) Leave(pxy Proxy) (empty bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for i, m := range g.members {
+		if m.pxy == pxy {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			g.buildRing()
+			if g.name != "" {
+				log.Info("proxy [", pxy.GetName(), "] leave group [", g.name, "], members:", len(g.members))
+			}
+			break
+		}
+	}
+	return len(g.members) == 0
+}
+
+func (g *ProxyGroup) Members() []Proxy {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	list := make([]Proxy, 0, len(g.members))
+	for _, m := range g.members {
+		list = append(list, m.pxy)
+	}
+	return list
+}
+
+//选择处理本次访问的代理，clientIP只在ip_hash时使用
+func (g *ProxyGroup) Pick(clientIP string) Proxy {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.members) == 0 {
+		return nil
+	}
+	if len(g.members) == 1 {
+		return g.members[0].pxy
+	}
+
+	switch g.strategy {
+	case LoadBalanceWeighted:
+		//平滑加权轮询
+		total := 0
+		var best *groupMember
+		for _, m := range g.members {
+			m.current += m.weight
+			total += m.weight
+			if best == nil || m.current > best.current {
+				best = m
+			}
+		}
+		best.current -= total
+		return best.pxy
+
+	case LoadBalanceIpHash:
+		h := crc32.ChecksumIEEE([]byte(clientIP))
+		i := sort.Search(len(g.ring), func(i int) bool {
+			return g.ring[i] >= h
+		})
+		if i == len(g.ring) {
+			i = 0
+		}
+		return g.ringNodes[g.ring[i]]
+
+	default:
+		g.next = (g.next + 1) % len(g.members)
+		return g.members[g.next].pxy
+	}
+}
+
+//成员变化时重建哈希环，只有变化的成员对应的访问者会被重新分配
+func (g *ProxyGroup) buildRing() {
+	if g.strategy != LoadBalanceIpHash {
+		return
+	}
+
+	g.ring = g.ring[:0]
+	g.ringNodes = make(map[uint32]Proxy)
+	for _, m := range g.members {
+		id := m.pxy.GetClient().clientId + "/" + m.pxy.GetName()
+		for i := 0; i < hashReplicas*m.weight; i++ {
+			h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", id, i)))
+			if _, ok := g.ringNodes[h]; ok {
+				continue
+			}
+			g.ringNodes[h] = m.pxy
+			g.ring = append(g.ring, h)
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool {
+		return g.ring[i] < g.ring[j]
+	})
+}
+
+//同一分组的tcp代理共享一个监听端口
+type TcpGroupManager struct {
+	svr *Service
+	//map[groupName]group
+	groups map[string]*tcpGroup
+
+	mu sync.Mutex
+}
+
+type tcpGroup struct {
+	group    *ProxyGroup
+	listener net.Listener
+	port     int
+}
+
+func NewTcpGroupManager(svr *Service) *TcpGroupManager {
+	return &TcpGroupManager{
+		svr:    svr,
+		groups: make(map[string]*tcpGroup),
+	}
+}
+
+//加入分组并返回分组使用的端口，第一个成员负责监听端口
+func (tm *TcpGroupManager) Join(pxy *TcpProxy) (port int, err error) {
+	m := pxy.GetMsg()
+	policy := pxy.clientCtrl.policy()
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tg, ok := tm.groups[m.Group]; ok {
+		if pxy.RemotePort != 0 && pxy.RemotePort != tg.port {
+			return 0, fmt.Errorf("group [%s] listens on port %d", m.Group, tg.port)
+		}
+		if !policy.AllowPort(tg.port) {
+			return 0, fmt.Errorf("remote port %d of group [%s] is not allowed for user [%s]", tg.port, m.Group, pxy.clientCtrl.loginMsg.User)
+		}
+		return tg.port, tg.group.Join(pxy)
+	}
+
+	pm := tm.svr.portManager
+	if port, err = pm.Acquire(m.Group, pxy.RemotePort, policy.PortRanges()); err != nil {
+		return
+	}
+	addr := fmt.Sprintf("%s:%d", tm.svr.getConf().BindIP, port)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pm.Release(port)
+		return
+	}
+
+	tg := &tcpGroup{
+		group:    NewProxyGroup(m.Group, m.GroupKey, m.LoadBalance),
+		listener: l,
+		port:     port,
+	}
+	tg.group.Join(pxy)
+	tm.groups[m.Group] = tg
+
+	go tm.accept(tg)
+	log.Info("tcp group [", m.Group, "] listen on ", addr)
+	return
+}
+
+//最后一个成员离开时关闭监听端口
+func (tm *TcpGroupManager) Leave(pxy *TcpProxy) {
+	name := pxy.GetMsg().Group
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tg, ok := tm.groups[name]
+	if !ok || !tg.group.Leave(pxy) {
+		return
+	}
+	delete(tm.groups, name)
+	tg.listener.Close()
+	tm.svr.portManager.Release(tg.port)
+	log.Info("tcp group [", name, "] is closed")
+}
+
+func (tm *TcpGroupManager) accept(tg *tcpGroup) {
+	for {
+		conn, err := tg.listener.Accept()
+		if err != nil {
+			log.Debug("tcp group [", tg.group.Name(), "] accept error:", err)
+			return
+		}
+
+		clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		pxy, ok := tg.group.Pick(clientIP).(*TcpProxy)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		go pxy.handleUserConn(conn)
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"proxy/config"
+	msg "proxy/message"
+)
+
+//按权重创建http代理并加入分组g
+func newGroupMembers(t *testing.T, g *ProxyGroup, weights ...int) []Proxy {
+	list := make([]Proxy, 0, len(weights))
+	for i, w := range weights {
+		pxy := newRouteProxy(t, fmt.Sprintf("p%d", i), msg.NewProxy{Group: g.Name(), GroupKey: "key", Weight: w})
+		if err := g.Join(pxy); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, pxy)
+	}
+	return list
+}
+
+func pickCount(g *ProxyGroup, n int) map[Proxy]int {
+	count := make(map[Proxy]int)
+	for i := 0; i < n; i++ {
+		count[g.Pick("")]++
+	}
+	return count
+}
+
+func TestProxyGroupRoundRobin(t *testing.T) {
+	g := NewProxyGroup("g", "key", "")
+	if g.Strategy() != LoadBalanceRoundRobin {
+		t.Fatal("default strategy is", g.Strategy())
+	}
+	members := newGroupMembers(t, g, 1, 5, 1)
+
+	var last Proxy
+	for i := 0; i < 9; i++ {
+		pxy := g.Pick("")
+		if pxy == last {
+			t.Fatal("the same member is picked twice in a row")
+		}
+		last = pxy
+	}
+	//轮询不考虑权重
+	count := pickCount(g, 9)
+	for _, pxy := range members {
+		if count[pxy] != 3 {
+			t.Fatalf("%s is picked %d times, want 3", pxy.GetName(), count[pxy])
+		}
+	}
+
+	g.Leave(members[1])
+	count = pickCount(g, 4)
+	if count[members[0]] != 2 || count[members[2]] != 2 {
+		t.Fatal("unexpected picks after leave:", count)
+	}
+}
+
+func TestProxyGroupWeighted(t *testing.T) {
+	g := NewProxyGroup("g", "key", LoadBalanceWeighted)
+	//权重为0按1处理
+	members := newGroupMembers(t, g, 3, 1, 0)
+
+	//每一轮按权重分配，同一轮中权重大的成员不会连续被选中
+	for round := 0; round < 3; round++ {
+		var seq []string
+		count := make(map[Proxy]int)
+		for i := 0; i < 5; i++ {
+			pxy := g.Pick("")
+			count[pxy]++
+			seq = append(seq, pxy.GetName())
+		}
+		if count[members[0]] != 3 || count[members[1]] != 1 || count[members[2]] != 1 {
+			t.Fatalf("round %d: unexpected picks %v", round, seq)
+		}
+		for i := 1; i < len(seq); i++ {
+			if seq[i] == seq[i-1] {
+				t.Fatalf("round %d: picks are not smooth %v", round, seq)
+			}
+		}
+	}
+
+	g.Leave(members[0])
+	count := pickCount(g, 4)
+	if count[members[1]] != 2 || count[members[2]] != 2 {
+		t.Fatal("unexpected picks after leave:", count)
+	}
+}
+
+func TestProxyGroupIpHash(t *testing.T) {
+	g := NewProxyGroup("g", "key", LoadBalanceIpHash)
+	members := newGroupMembers(t, g, 1, 1, 1)
+
+	ips := make([]string, 300)
+	before := make(map[string]Proxy)
+	count := make(map[Proxy]int)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		before[ips[i]] = g.Pick(ips[i])
+		count[before[ips[i]]]++
+		if g.Pick(ips[i]) != before[ips[i]] {
+			t.Fatal("the same ip is assigned to another member:", ips[i])
+		}
+	}
+	for _, pxy := range members {
+		if count[pxy] < 50 {
+			t.Fatalf("%s gets %d of %d ips", pxy.GetName(), count[pxy], len(ips))
+		}
+	}
+
+	//成员离开时只有它的访问者被重新分配
+	g.Leave(members[1])
+	for _, ip := range ips {
+		pxy := g.Pick(ip)
+		if pxy == members[1] {
+			t.Fatal("ip is assigned to the removed member:", ip)
+		}
+		if before[ip] != members[1] && pxy != before[ip] {
+			t.Fatal("ip of a remaining member is moved:", ip)
+		}
+	}
+
+	//重新加入后恢复原来的分配
+	if err := g.Join(members[1]); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range ips {
+		if g.Pick(ip) != before[ip] {
+			t.Fatal("ip is not assigned back after rejoin:", ip)
+		}
+	}
+}
+
+func TestProxyGroupJoinLeave(t *testing.T) {
+	g := NewProxyGroup("g", "key", LoadBalanceWeighted)
+	if g.Pick("") != nil {
+		t.Fatal("empty group picks a proxy")
+	}
+	members := newGroupMembers(t, g, 1, 1)
+
+	cases := map[string]msg.NewProxy{
+		"wrong group_key":    {Group: "g", GroupKey: "wrong"},
+		"empty group_key":    {Group: "g"},
+		"other load_balance": {Group: "g", GroupKey: "key", LoadBalance: LoadBalanceIpHash},
+		"round_robin":        {Group: "g", GroupKey: "key", LoadBalance: LoadBalanceRoundRobin},
+	}
+	for name, m := range cases {
+		if err := g.Join(newRouteProxy(t, "bad", m)); err == nil {
+			t.Errorf("%s: join succeeded", name)
+		}
+	}
+	//没有指定load_balance时使用分组的策略
+	extra := newRouteProxy(t, "extra", msg.NewProxy{Group: "g", GroupKey: "key"})
+	if err := g.Join(extra); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Members()) != 3 {
+		t.Fatal("members:", len(g.Members()))
+	}
+
+	if g.Leave(newRouteProxy(t, "other", msg.NewProxy{})) {
+		t.Fatal("group is empty after an unknown proxy leaves")
+	}
+	if g.Leave(members[0]) || g.Leave(extra) {
+		t.Fatal("group is empty while it still has members")
+	}
+	if !g.Leave(members[1]) {
+		t.Fatal("group is not empty after the last member leaves")
+	}
+	if g.Pick("") != nil {
+		t.Fatal("empty group picks a proxy")
+	}
+
+	//没有分组的路由只能有一个代理
+	single := NewProxyGroup("", "", "")
+	newGroupMembers(t, single, 1)
+	if err := single.Join(newRouteProxy(t, "second", msg.NewProxy{})); err == nil {
+		t.Fatal("second proxy joins an ungrouped route")
+	}
+}
+
+func newGroupTcpProxy(t *testing.T, svr *Service, name, key string, remotePort int) *TcpProxy {
+	ctrl := &ClientCtrl{svr: svr, clientId: name, loginMsg: &msg.Login{User: testUser}}
+	pxy, err := NewProxy(ctrl, msg.NewProxy{ProxyName: name, ProxyType: "tcp", Group: "g", GroupKey: key, RemotePort: remotePort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pxy.(*TcpProxy)
+}
+
+//分组的第一个成员监听端口，之后的成员共享该端口，最后一个成员离开时关闭监听并释放端口
+func TestTcpGroupManager(t *testing.T) {
+	svr := newTestService(t, nil)
+	tm := svr.tcpGroups
+
+	a := newGroupTcpProxy(t, svr, "a", "key", 0)
+	if err := a.Run(); err != nil {
+		t.Fatal(err)
+	}
+	port := a.GetMsg().RemotePort
+	if port == 0 {
+		t.Fatal("group port is not assigned")
+	}
+	b := newGroupTcpProxy(t, svr, "b", "key", port)
+	if err := b.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if b.GetMsg().RemotePort != port {
+		t.Fatal("member listens on port", b.GetMsg().RemotePort, "want", port)
+	}
+
+	if err := newGroupTcpProxy(t, svr, "c", "wrong", 0).Run(); err == nil {
+		t.Fatal("member with wrong group_key joins")
+	}
+	if err := newGroupTcpProxy(t, svr, "d", "key", freePort(t)).Run(); err == nil {
+		t.Fatal("member with another remote_port joins")
+	}
+	if n := len(tm.groups["g"].group.Members()); n != 2 {
+		t.Fatal("group members:", n)
+	}
+
+	portBound := func() bool {
+		l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			return true
+		}
+		l.Close()
+		return false
+	}
+
+	a.Close()
+	if _, ok := tm.groups["g"]; !ok || !portBound() {
+		t.Fatal("group is closed while it still has members")
+	}
+
+	b.Close()
+	if _, ok := tm.groups["g"]; ok {
+		t.Fatal("group is not removed after the last member leaves")
+	}
+	if portBound() {
+		t.Fatal("group port is still bound")
+	}
+	if _, err := svr.portManager.Acquire("new", port, nil); err != nil {
+		t.Fatal("group port is not released:", err)
+	}
+	svr.portManager.Release(port)
+}
+
+//连接后返回name的本地服务
+func newNameServer(t *testing.T, name string) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+//两个客户端的代理加入同一分组，访问者轮流转发到两个本地服务
+func TestTcpGroupEndToEnd(t *testing.T) {
+	svr := newTestService(t, nil)
+	for _, name := range []string{"web1", "web2"} {
+		newTestClient(t, svr, nil, &config.ProxyConf{
+			Name:      name,
+			Type:      "tcp",
+			LocalIP:   "127.0.0.1",
+			LocalPort: newNameServer(t, name),
+			Group:     "g",
+			GroupKey:  "key",
+		})
+	}
+	waitFor(t, 5*time.Second, "group members", func() bool {
+		svr.tcpGroups.mu.Lock()
+		defer svr.tcpGroups.mu.Unlock()
+		tg, ok := svr.tcpGroups.groups["g"]
+		return ok && len(tg.group.Members()) == 2
+	})
+	port := svr.tcpGroups.groups["g"].port
+
+	count := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		data, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count[string(data)]++
+	}
+	if count["web1"] != 2 || count["web2"] != 2 {
+		t.Fatal("unexpected balance:", count)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+	"proxy/utils"
+)
+
+//http代理的请求统计，被拒绝的请求不会获取工作连接
+type HttpStats struct {
+	Requests     int64 `json:"requests"`
+	AuthRejected int64 `json:"auth_rejected"` //401
+	IpRejected   int64 `json:"ip_rejected"`   //403
+}
+
+func (s *HttpStats) Snapshot() HttpStats {
+	return HttpStats{
+		Requests:     atomic.LoadInt64(&s.Requests),
+		AuthRejected: atomic.LoadInt64(&s.AuthRejected),
+		IpRejected:   atomic.LoadInt64(&s.IpRejected),
+	}
+}
+
+//解析allow_ips和deny_ips，支持CIDR和单个IP
+func parseIpNets(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip [%s]", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr [%s]", s)
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+func containsIp(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//deny_ips优先；配置了allow_ips时只允许其中的地址
+func (pxy *HttpProxy) allowIp(clientIP string) bool {
+	if len(pxy.allowNets) == 0 && len(pxy.denyNets) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	if containsIp(pxy.denyNets, ip) {
+		return false
+	}
+	return len(pxy.allowNets) == 0 || containsIp(pxy.allowNets, ip)
+}
+
+func (pxy *HttpProxy) checkBasicAuth(req *http.Request) bool {
+	if pxy.Msg.HttpUser == "" && pxy.Msg.HttpPwd == "" {
+		return true
+	}
+	user, pwd, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	//两项都比较，避免根据耗时判断用户名是否正确
+	userOk := utils.SecureEqual(user, pxy.Msg.HttpUser)
+	pwdOk := utils.SecureEqual(pwd, pxy.Msg.HttpPwd)
+	return userOk && pwdOk
+}
+
+//检查访问者地址和basic认证，不通过时直接回复403或401
+func (pxy *HttpProxy) checkAccess(rw http.ResponseWriter, req *http.Request, clientIP string) bool {
+	atomic.AddInt64(&pxy.httpStats.Requests, 1)
+
+	if !pxy.allowIp(clientIP) {
+		atomic.AddInt64(&pxy.httpStats.IpRejected, 1)
+		log.Warn("http proxy [", pxy.Name, "] reject request from ", clientIP)
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	if !pxy.checkBasicAuth(req) {
+		atomic.AddInt64(&pxy.httpStats.AuthRejected, 1)
+		log.Debug("http proxy [", pxy.Name, "] basic auth failed from ", clientIP)
+		rw.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (pxy *HttpProxy) GetHttpStats() HttpStats {
+	return pxy.httpStats.Snapshot()
+}
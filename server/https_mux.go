@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"proxy/utils"
+)
+
+//根据TLS ClientHello中的SNI将https连接转发到对应的代理，不解密TLS
+type HttpsMuxer struct {
+	listener net.Listener
+	//map[domain]proxy
+	domains map[string]Proxy
+
+	mu sync.RWMutex
+}
+
+func NewHttpsMuxer(l net.Listener) (hm *HttpsMuxer) {
+	hm = &HttpsMuxer{
+		listener: l,
+		domains:  make(map[string]Proxy),
+	}
+	return
+}
+
+func (hm *HttpsMuxer) Run() {
+	for {
+		conn, err := hm.listener.Accept()
+		if err != nil {
+			log.Warn("https muxer accept error:", err)
+			return
+		}
+		go hm.handleConn(conn)
+	}
+}
+
+func (hm *HttpsMuxer) Register(domain string, pxy Proxy) error {
+	domain = strings.ToLower(domain)
+	if domain == "" {
+		return fmt.Errorf("Register error:domain is empty")
+	}
+
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	if _, ok := hm.domains[domain]; ok {
+		return fmt.Errorf("Register error:domain [%s] is existed", domain)
+	}
+	hm.domains[domain] = pxy
+	log.Debug("add https domain ", domain)
+	return nil
+}
+
+func (hm *HttpsMuxer) Remove(domain string, pxy Proxy) {
+	domain = strings.ToLower(domain)
+
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	if p, ok := hm.domains[domain]; ok && p == pxy {
+		delete(hm.domains, domain)
+	}
+}
+
+func (hm *HttpsMuxer) Get(domain string) (pxy Proxy, ok bool) {
+	hm.mu.RLock()
+	defer hm.mu.RUnlock()
+
+	pxy, ok = hm.domains[strings.ToLower(domain)]
+	return
+}
+
+func (hm *HttpsMuxer) handleConn(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+	serverName, hello, err := readServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Warn("read https server name error:", err)
+		conn.Close()
+		return
+	}
+
+	pxy, ok := hm.Get(serverName)
+	if !ok {
+		log.Warn("https proxy not found for domain:", serverName)
+		conn.Close()
+		return
+	}
+
+	workConn, err := pxy.GetUserWorkConn(conn)
+	if err != nil {
+		log.Error("https proxy [", pxy.GetName(), "] get work connection error:", err)
+		conn.Close()
+		return
+	}
+
+	userConn := &replayConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader(hello), conn),
+	}
+	utils.BridgeConn(userConn, workConn)
+}
+
+//读取ClientHello并返回其中的SNI，以及已经读取的原始数据
+func readServerName(conn net.Conn) (serverName string, data []byte, err error) {
+	buf := bytes.NewBuffer(nil)
+	rc := &readOnlyConn{
+		r: io.TeeReader(conn, buf),
+	}
+
+	tls.Server(rc, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	data = buf.Bytes()
+	if serverName == "" {
+		err = fmt.Errorf("no server name found in ClientHello")
+	}
+	return
+}
+
+var errHelloRead = fmt.Errorf("client hello is read")
+
+//只用于解析ClientHello，所有写操作都会失败
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+//先返回已经读取的数据，再继续读取原连接
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
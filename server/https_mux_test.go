@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+//工作连接为内存管道的代理，另一端从conns中取出
+type pipeProxy struct {
+	Proxy
+	name  string
+	conns chan net.Conn
+}
+
+func newPipeProxy(name string) *pipeProxy {
+	return &pipeProxy{name: name, conns: make(chan net.Conn, 16)}
+}
+
+func (p *pipeProxy) GetName() string { return p.name }
+
+func (p *pipeProxy) GetWorkConn() (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	p.conns <- c2
+	return c1, nil
+}
+
+func (p *pipeProxy) GetUserWorkConn(userConn net.Conn) (net.Conn, error) {
+	return p.GetWorkConn()
+}
+
+func (p *pipeProxy) accept(t *testing.T) net.Conn {
+	select {
+	case conn := <-p.conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy", p.name, "receives no work connection")
+		return nil
+	}
+}
+
+func newTestCertificate(t *testing.T, host string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTestHttpsMuxer(t *testing.T) (*HttpsMuxer, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	hm := NewHttpsMuxer(l)
+	go hm.Run()
+	return hm, l.Addr().String()
+}
+
+//按SNI转发到对应的代理，本地服务收到完整的ClientHello并完成握手
+func TestHttpsMuxerRouteBySni(t *testing.T) {
+	hm, addr := newTestHttpsMuxer(t)
+	a, b := newPipeProxy("a"), newPipeProxy("b")
+	if err := hm.Register("a.example.com", a); err != nil {
+		t.Fatal(err)
+	}
+	if err := hm.Register("B.example.com", b); err != nil {
+		t.Fatal(err)
+	}
+	if err := hm.Register("a.example.com", b); err == nil {
+		t.Fatal("duplicate domain is registered")
+	}
+
+	for _, c := range []struct {
+		host string
+		pxy  *pipeProxy
+	}{{"a.example.com", a}, {"b.example.com", b}} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := tls.Client(conn, &tls.Config{ServerName: c.host, InsecureSkipVerify: true})
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- client.Handshake()
+		}()
+
+		cert := newTestCertificate(t, c.host)
+		server := tls.Server(c.pxy.accept(t), &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := server.Handshake(); err != nil {
+			t.Fatalf("%s: local service handshake: %v", c.host, err)
+		}
+		if server.ConnectionState().ServerName != c.host {
+			t.Fatalf("%s: local service gets server name %q", c.host, server.ConnectionState().ServerName)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("%s: client handshake: %v", c.host, err)
+		}
+
+		//握手之后的数据双向转发
+		go server.Write([]byte("hello " + c.host))
+		buf := make([]byte, len("hello "+c.host))
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "hello "+c.host {
+			t.Fatalf("%s: read %q, %v", c.host, buf, err)
+		}
+	}
+}
+
+//未注册的域名和没有SNI的连接被关闭
+func TestHttpsMuxerRejectUnknownSni(t *testing.T) {
+	hm, addr := newTestHttpsMuxer(t)
+	a := newPipeProxy("a")
+	hm.Register("a.example.com", a)
+
+	for _, host := range []string{"unknown.example.com", ""} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		//没有ServerName时不发送SNI扩展
+		err = tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true}).Handshake()
+		if err == nil {
+			t.Fatalf("%q: handshake succeeded", host)
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatalf("%q: connection is not closed", host)
+		}
+	}
+
+	hm.Remove("a.example.com", a)
+	if _, ok := hm.Get("a.example.com"); ok {
+		t.Fatal("removed domain is still routed")
+	}
+	select {
+	case <-a.conns:
+		t.Fatal("rejected connection reaches a proxy")
+	default:
+	}
+}
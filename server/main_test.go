@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"proxy/client"
+	"proxy/config"
+)
+
+const (
+	testUser  = "test"
+	testToken = "123456"
+)
+
+func TestMain(m *testing.M) {
+	log.ReplaceLogger(log.Disabled)
+	os.Exit(m.Run())
+}
+
+//在127.0.0.1的随机端口上启动服务器，fn可以在启动前修改配置
+func newTestService(t testing.TB, fn func(conf *config.ServerConfig)) *Service {
+	dir, err := ioutil.TempDir("", "proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "usertoken.json")
+	data, _ := json.Marshal(map[string]string{testUser: testToken})
+	if err = ioutil.WriteFile(tokenFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &config.ServerConfig{
+		BindIP:        "127.0.0.1",
+		UserTokenFile: tokenFile,
+		PingTimeout:   30,
+		HttpProxy:     &config.HttpProxyConf{},
+	}
+	if fn != nil {
+		fn(conf)
+	}
+
+	svr, err := NewService(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go svr.Run()
+	t.Cleanup(func() {
+		svr.Close()
+		os.RemoveAll(dir)
+	})
+	return svr
+}
+
+//启动连接到svr的客户端，测试结束时关闭；fn可以在启动前修改配置
+func newTestClient(t testing.TB, svr *Service, fn func(conf *config.ClientConfig), proxies ...*config.ProxyConf) *client.Client {
+	conf := &config.ClientConfig{
+		ServerIP:     "127.0.0.1",
+		ServerPort:   svr.listener.Addr().(*net.TCPAddr).Port,
+		User:         testUser,
+		Token:        testToken,
+		PingInterval: 10,
+		PongTimeout:  30,
+		AllProxy:     proxies,
+	}
+	if fn != nil {
+		fn(conf)
+	}
+	c, err := client.NewClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.Run()
+	t.Cleanup(c.Close)
+	return c
+}
+
+//回显收到的数据，返回监听的端口
+func newEchoServer(t testing.TB) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func waitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for ", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//等待客户端登录并注册完所有代理，返回对应的ClientCtrl
+func waitProxies(t testing.TB, svr *Service, n int) *ClientCtrl {
+	var ctrl *ClientCtrl
+	waitFor(t, 5*time.Second, "proxies registered", func() bool {
+		for _, c := range svr.clientManager.List() {
+			if len(c.GetProxies()) == n {
+				ctrl = c
+				return true
+			}
+		}
+		return false
+	})
+	return ctrl
+}
+
+func getProxy(t testing.TB, c *ClientCtrl, name string) Proxy {
+	for _, p := range c.GetProxies() {
+		if p.GetName() == name {
+			return p
+		}
+	}
+	t.Fatal("proxy not found:", name)
+	return nil
+}
+
+//通过conn发送data并读取相同长度的回显
+func echoRoundTrip(t testing.TB, conn net.Conn, data []byte) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(data) {
+		t.Fatalf("echo mismatch: got %q, want %q", buf, data)
+	}
+	conn.SetDeadline(time.Time{})
+}
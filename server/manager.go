@@ -1,20 +1,71 @@
 package server
 
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"proxy/config"
+)
+
+//并发安全的客户端注册表
 type ClientManager struct {
 	//map[clientID]client
-	Client map[string]*ClientCtrl
+	clients map[string]*ClientCtrl
+
+	mu sync.RWMutex
 }
 
 func NewClientManager() (cm *ClientManager) {
 	cm = &ClientManager{
-		Client: make(map[string]*ClientCtrl),
+		clients: make(map[string]*ClientCtrl),
 	}
 	return
 
 }
 
-func (cm *ClientManager) Add(clientId string, clientCtrl *ClientCtrl) {
-	cm.Client[clientId] = clientCtrl
+//登记客户端。clientId已被同一用户使用时返回旧的客户端，由调用者关闭并接管；
+//被其他用户使用时返回错误
+func (cm *ClientManager) Add(clientId string, clientCtrl *ClientCtrl) (old *ClientCtrl, err error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if c, ok := cm.clients[clientId]; ok {
+		if c.loginMsg.User != clientCtrl.loginMsg.User {
+			err = fmt.Errorf("client id [%s] is used by another user", clientId)
+			return
+		}
+		old = c
+	}
+	cm.clients[clientId] = clientCtrl
+	return
+}
+
+func (cm *ClientManager) Get(clientId string) (c *ClientCtrl, ok bool) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	c, ok = cm.clients[clientId]
+	return
+}
+
+//只有当前登记的仍是该客户端时才删除，避免删除同一id的新连接
+func (cm *ClientManager) Remove(clientId string, clientCtrl *ClientCtrl) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if c, ok := cm.clients[clientId]; ok && c == clientCtrl {
+		delete(cm.clients, clientId)
+	}
+}
+
+func (cm *ClientManager) List() []*ClientCtrl {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	list := make([]*ClientCtrl, 0, len(cm.clients))
+	for _, c := range cm.clients {
+		list = append(list, c)
+	}
+	return list
 }
 
 type ProxyManager struct {
@@ -26,3 +77,159 @@ func NewProxyManager() (pm *ProxyManager) {
 	return
 
 }
+
+//管理tcp代理使用的远程端口，保证同一端口只能被一个代理占用
+type PortManager struct {
+	//"tcp" or "udp"
+	network    string
+	allowPorts []config.PortRange
+	//map[port]proxyName
+	used map[int]string
+
+	mu sync.Mutex
+}
+
+func NewPortManager(network string, allowPorts []config.PortRange) (pm *PortManager) {
+	pm = &PortManager{
+		network:    network,
+		allowPorts: allowPorts,
+		used:       make(map[int]string),
+	}
+	return
+}
+
+//占用端口，port为0时由服务器从允许的范围内分配，limit不为空时还需要在limit范围内
+func (pm *PortManager) Acquire(name string, port int, limit []config.PortRange) (int, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if port == 0 {
+		if len(limit) > 0 {
+			return pm.allocateIn(name, limit)
+		}
+		return pm.allocate(name)
+	}
+
+	if !pm.isAllowed(port) {
+		return 0, fmt.Errorf("remote port %d is not allowed", port)
+	}
+	if owner, ok := pm.used[port]; ok {
+		return 0, fmt.Errorf("remote port %d is already used by proxy [%s]", port, owner)
+	}
+	pm.used[port] = name
+	return port, nil
+}
+
+//修改允许的端口范围，已经占用的端口不受影响
+func (pm *PortManager) SetAllowPorts(allowPorts []config.PortRange) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.allowPorts = allowPorts
+}
+
+func (pm *PortManager) Release(port int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	delete(pm.used, port)
+}
+
+func (pm *PortManager) isAllowed(port int) bool {
+	if len(pm.allowPorts) == 0 {
+		return true
+	}
+	for _, r := range pm.allowPorts {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pm *PortManager) allocate(name string) (int, error) {
+	if len(pm.allowPorts) == 0 {
+		//没有配置端口范围时，由系统分配一个空闲端口
+		for i := 0; i < 10; i++ {
+			port, err := pm.freePort()
+			if err != nil {
+				return 0, err
+			}
+			if _, ok := pm.used[port]; !ok {
+				pm.used[port] = name
+				return port, nil
+			}
+		}
+		return 0, fmt.Errorf("no available remote port")
+	}
+
+	for _, r := range pm.allowPorts {
+		for port := r.Min; port <= r.Max; port++ {
+			if _, ok := pm.used[port]; ok {
+				continue
+			}
+			if !pm.isPortAvailable(port) {
+				continue
+			}
+			pm.used[port] = name
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no available remote port in allow_ports")
+}
+
+func (pm *PortManager) allocateIn(name string, limit []config.PortRange) (int, error) {
+	for _, r := range limit {
+		for port := r.Min; port <= r.Max; port++ {
+			if !pm.isAllowed(port) {
+				continue
+			}
+			if _, ok := pm.used[port]; ok {
+				continue
+			}
+			if !pm.isPortAvailable(port) {
+				continue
+			}
+			pm.used[port] = name
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no available remote port in the ports allowed for this user")
+}
+
+func (pm *PortManager) isPortAvailable(port int) bool {
+	addr := fmt.Sprintf(":%d", port)
+	if pm.network == "udp" {
+		c, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+func (pm *PortManager) freePort() (int, error) {
+	if pm.network == "udp" {
+		c, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return 0, err
+		}
+		defer c.Close()
+		return c.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
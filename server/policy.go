@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+
+	"proxy/config"
+	msg "proxy/message"
+)
+
+func (c *ClientCtrl) policy() *config.UserPolicy {
+	return c.svr.getUserPolicy(c.loginMsg.User)
+}
+
+//检查用户是否可以注册该代理，违反策略时返回具体的原因。
+//限制了max_proxies时调用者需要持有svr.policyMu，直到代理加入代理表
+func (c *ClientCtrl) checkPolicy(m msg.NewProxy) error {
+	user := c.loginMsg.User
+	p := c.policy()
+	if p == nil {
+		return nil
+	}
+
+	if !p.AllowType(m.ProxyType) {
+		return fmt.Errorf("proxy type %s is not allowed for user [%s], allowed types: %v", m.ProxyType, user, p.AllowTypes)
+	}
+
+	switch m.ProxyType {
+	case "tcp", "udp":
+		if m.RemotePort != 0 && !p.AllowPort(m.RemotePort) {
+			return fmt.Errorf("remote port %d is not allowed for user [%s], allowed ports: %s", m.RemotePort, user, p.AllowPorts)
+		}
+	case "http", "https":
+		if !p.AllowDomain(m.Domain) {
+			return fmt.Errorf("domain %s is not allowed for user [%s], allowed domains: %v", m.Domain, user, p.AllowDomains)
+		}
+	}
+
+	if p.MaxProxies > 0 {
+		count := 0
+		for _, client := range c.svr.clientManager.List() {
+			if client.loginMsg.User == user {
+				count += len(client.GetProxies())
+			}
+		}
+		if count >= p.MaxProxies {
+			return fmt.Errorf("user [%s] has reached the maximum number of proxies (%d)", user, p.MaxProxies)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"proxy/config"
+	msg "proxy/message"
+)
+
+//并发注册时代理总数不超过max_proxies
+func TestMaxProxiesConcurrentRegister(t *testing.T) {
+	svr := newTestService(t, func(conf *config.ServerConfig) {
+		conf.UserPolicyFile = filepath.Join(filepath.Dir(conf.UserTokenFile), "policy.json")
+		writeTestFile(t, conf.UserPolicyFile, `{"test": {"max_proxies": 3}}`)
+	})
+	newTestClient(t, svr, nil)
+	ctrl := waitProxies(t, svr, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctrl.RegisterProxy(msg.NewProxy{ProxyName: fmt.Sprintf("p%d", i), ProxyType: "tcp"})
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(ctrl.GetProxies()); n != 3 {
+		t.Fatalf("%d proxies registered, max_proxies is 3", n)
+	}
+}
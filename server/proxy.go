@@ -1,8 +1,12 @@
 package server
 
 import (
+	"fmt"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	log "github.com/cihub/seelog"
 	msg "proxy/message"
@@ -10,18 +14,21 @@ import (
 )
 
 type Proxy interface {
-	Run()
+	Run() error
 	Close()
 
 	GetWorkConn() (conn net.Conn, err error)
+	//为访问者连接获取工作连接，访问者地址通过StartWork告知客户端
+	GetUserWorkConn(userConn net.Conn) (conn net.Conn, err error)
 
 	GetName() string
 	GetType() string
 	GetClient() *ClientCtrl
 	GetMsg() msg.NewProxy
+	GetCompressStats() utils.CompressStats
 }
 
-func NewProxy(c *ClientCtrl, m msg.NewProxy) (pxy Proxy) {
+func NewProxy(c *ClientCtrl, m msg.NewProxy) (pxy Proxy, err error) {
 	baseProxy := BaseProxy{
 		Name:       m.ProxyName,
 		Type:       m.ProxyType,
@@ -29,6 +36,36 @@ func NewProxy(c *ClientCtrl, m msg.NewProxy) (pxy Proxy) {
 		Msg:        m,
 	}
 
+	if m.Encrypt {
+		switch m.EncryptMethod {
+		case "", utils.EncryptMethodCfb, utils.EncryptMethodGcm:
+		default:
+			err = fmt.Errorf("encryption method [%s] is not supported", m.EncryptMethod)
+			return
+		}
+	}
+
+	if !utils.IsValidCompression(m.Compression) {
+		err = fmt.Errorf("compression [%s] is not supported", m.Compression)
+		return
+	}
+
+	if m.Group != "" {
+		if m.ProxyType != "tcp" && m.ProxyType != "http" {
+			err = fmt.Errorf("group is only supported for tcp and http proxy")
+			return
+		}
+		if !IsValidLoadBalance(m.LoadBalance) {
+			err = fmt.Errorf("load_balance [%s] is not supported", m.LoadBalance)
+			return
+		}
+	}
+
+	if m.RewritePath != "" && !strings.HasPrefix(m.RewritePath, "/") {
+		err = fmt.Errorf("rewrite_path [%s] must start with /", m.RewritePath)
+		return
+	}
+
 	switch m.ProxyType {
 	case "tcp":
 		pxy = &TcpProxy{
@@ -38,7 +75,7 @@ func NewProxy(c *ClientCtrl, m msg.NewProxy) (pxy Proxy) {
 		}
 
 	case "http":
-		pxy = &HttpProxy{
+		hpxy := &HttpProxy{
 			BaseProxy:  baseProxy,
 			RemotePort: m.RemotePort,
 			Encrypt:    m.Encrypt,
@@ -46,14 +83,35 @@ func NewProxy(c *ClientCtrl, m msg.NewProxy) (pxy Proxy) {
 			Domain:     m.Domain,
 			Url:        m.Url,
 		}
+		if hpxy.allowNets, err = parseIpNets(m.AllowIPs); err != nil {
+			err = fmt.Errorf("allow_ips error:%v", err)
+			return
+		}
+		if hpxy.denyNets, err = parseIpNets(m.DenyIPs); err != nil {
+			err = fmt.Errorf("deny_ips error:%v", err)
+			return
+		}
+		pxy = hpxy
 
 	case "https":
 		pxy = &HttpsProxy{
 			BaseProxy:  baseProxy,
 			RemotePort: m.RemotePort,
 			Encrypt:    m.Encrypt,
+			Domain:     m.Domain,
+		}
+
+	case "udp":
+		pxy = &UdpProxy{
+			BaseProxy:  baseProxy,
+			RemotePort: m.RemotePort,
+			Encrypt:    m.Encrypt,
+			sendCh:     make(chan *msg.UdpPacket, 64),
+			closeCh:    make(chan struct{}),
 		}
 
+	default:
+		err = fmt.Errorf("proxy type [%s] is not supported", m.ProxyType)
 	}
 
 	return
@@ -67,7 +125,7 @@ type BaseProxy struct {
 	clientCtrl *ClientCtrl
 	Msg        msg.NewProxy
 
-	mu sync.RWMutex
+	compressStats utils.CompressStats
 }
 
 func (b *BaseProxy) GetName() string {
@@ -82,8 +140,23 @@ func (b *BaseProxy) GetClient() *ClientCtrl {
 func (b *BaseProxy) GetMsg() msg.NewProxy {
 	return b.Msg
 }
+func (b *BaseProxy) GetCompressStats() utils.CompressStats {
+	return b.compressStats.Snapshot()
+}
 
 func (pxy *BaseProxy) GetWorkConn() (conn net.Conn, err error) {
+	return pxy.getWorkConn(msg.StartWork{ProxyName: pxy.Name})
+}
+
+func (pxy *BaseProxy) GetUserWorkConn(userConn net.Conn) (conn net.Conn, err error) {
+	return pxy.getWorkConn(msg.StartWork{
+		ProxyName: pxy.Name,
+		SrcAddr:   userConn.RemoteAddr().String(),
+		DstAddr:   userConn.LocalAddr().String(),
+	})
+}
+
+func (pxy *BaseProxy) getWorkConn(m msg.StartWork) (conn net.Conn, err error) {
 	c := pxy.clientCtrl
 
 	for i := 0; i < c.loginMsg.ConnPoolCount+1; i++ {
@@ -92,9 +165,6 @@ func (pxy *BaseProxy) GetWorkConn() (conn net.Conn, err error) {
 			return
 		}
 
-		m := msg.StartWork{
-			ProxyName: pxy.Name,
-		}
 		err = msg.WriteMsg(msg.TypeStartWork, m, conn)
 
 		if err != nil {
@@ -104,10 +174,17 @@ func (pxy *BaseProxy) GetWorkConn() (conn net.Conn, err error) {
 			break
 		}
 	}
+	if err != nil {
+		return
+	}
 
 	if pxy.Msg.Encrypt {
-		conn, err = utils.Encryption(conn, []byte(pxy.clientCtrl.token))
+		if conn, err = utils.Encryption(conn, []byte(pxy.clientCtrl.token), pxy.Msg.EncryptMethod, utils.RoleServer); err != nil {
+			return
+		}
 	}
+
+	conn, err = utils.Compression(conn, pxy.Msg.Compression, &pxy.compressStats)
 	return
 }
 
@@ -115,12 +192,100 @@ type TcpProxy struct {
 	BaseProxy
 	RemotePort int
 	Encrypt    bool
+
+	listener net.Listener
+	closed   bool
+	mu       sync.Mutex
 }
 
-func (pxy *TcpProxy) Run() {
+func (pxy *TcpProxy) Run() (err error) {
+	if pxy.Msg.Group != "" {
+		return pxy.runInGroup()
+	}
 
+	pm := pxy.clientCtrl.svr.portManager
+	port, err := pm.Acquire(pxy.Name, pxy.RemotePort, pxy.clientCtrl.policy().PortRanges())
+	if err != nil {
+		return
+	}
+
+	addr := fmt.Sprintf("%s:%d", pxy.clientCtrl.svr.getConf().BindIP, port)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pm.Release(port)
+		return
+	}
+
+	pxy.mu.Lock()
+	pxy.listener = l
+	pxy.RemotePort = port
+	pxy.Msg.RemotePort = port
+	pxy.mu.Unlock()
+
+	go pxy.accept(l)
+	log.Info("tcp proxy [", pxy.Name, "] listen on ", addr)
+	return
 }
+
+//分组中的代理共享分组的监听端口
+func (pxy *TcpProxy) runInGroup() (err error) {
+	port, err := pxy.clientCtrl.svr.tcpGroups.Join(pxy)
+	if err != nil {
+		return
+	}
+
+	pxy.mu.Lock()
+	pxy.RemotePort = port
+	pxy.Msg.RemotePort = port
+	pxy.mu.Unlock()
+	return
+}
+
+func (pxy *TcpProxy) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			pxy.mu.Lock()
+			closed := pxy.closed
+			pxy.mu.Unlock()
+			if !closed {
+				log.Warn("tcp proxy [", pxy.Name, "] accept error:", err)
+			}
+			return
+		}
+		log.Debug("tcp proxy [", pxy.Name, "] accept user connection")
+		go pxy.handleUserConn(conn)
+	}
+}
+
+func (pxy *TcpProxy) handleUserConn(userConn net.Conn) {
+	workConn, err := pxy.GetUserWorkConn(userConn)
+	if err != nil {
+		log.Error("tcp proxy [", pxy.Name, "] get work connection error:", err)
+		userConn.Close()
+		return
+	}
+
+	utils.BridgeConn(userConn, workConn)
+	log.Debug("tcp proxy [", pxy.Name, "] user connection closed")
+}
+
 func (pxy *TcpProxy) Close() {
+	pxy.mu.Lock()
+	defer pxy.mu.Unlock()
+
+	if pxy.closed {
+		return
+	}
+	pxy.closed = true
+	if pxy.listener != nil {
+		pxy.listener.Close()
+		pxy.clientCtrl.svr.portManager.Release(pxy.RemotePort)
+	}
+	if pxy.Msg.Group != "" {
+		pxy.clientCtrl.svr.tcpGroups.Leave(pxy)
+	}
+	log.Debug("tcp proxy [", pxy.Name, "] is closed")
 }
 
 type HttpProxy struct {
@@ -130,19 +295,36 @@ type HttpProxy struct {
 	Host       string
 	Domain     string
 	Url        string
+
+	//复用工作连接
+	transport *http.Transport
+
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+	httpStats HttpStats
 }
 
-func (pxy *HttpProxy) Run() {
-	err := pxy.clientCtrl.svr.httpReverseProxy.Register(pxy.Domain, pxy.Url, pxy)
+func (pxy *HttpProxy) Run() (err error) {
+	hp := pxy.clientCtrl.svr.httpReverseProxy
+	if hp == nil {
+		return fmt.Errorf("http proxy is not enabled on server")
+	}
+	pxy.transport = hp.NewTransport(pxy)
+	err = hp.Register(pxy.Domain, pxy.Url, pxy)
 	if err != nil {
 		log.Error("register http proxy error:", err)
-		pxy.Close()
+		return
 	}
 	log.Debug("HttpProxy is running")
+	return
 }
 
 func (pxy *HttpProxy) Close() {
-	pxy.clientCtrl.svr.httpReverseProxy.Remove(pxy.Domain, pxy.Url)
+	if pxy.clientCtrl.svr.httpReverseProxy == nil {
+		return
+	}
+	pxy.clientCtrl.svr.httpReverseProxy.Remove(pxy.Domain, pxy.Url, pxy)
+	pxy.transport.CloseIdleConnections()
 	log.Debug("httpProxy is Closed")
 }
 
@@ -150,10 +332,184 @@ type HttpsProxy struct {
 	BaseProxy
 	RemotePort int
 	Encrypt    bool
+	Domain     string
 }
 
-func (pxy *HttpsProxy) Run() {
-
+func (pxy *HttpsProxy) Run() (err error) {
+	if pxy.clientCtrl.svr.httpsMuxer == nil {
+		return fmt.Errorf("https proxy is not enabled on server")
+	}
+	err = pxy.clientCtrl.svr.httpsMuxer.Register(pxy.Domain, pxy)
+	if err != nil {
+		log.Error("register https proxy error:", err)
+		return
+	}
+	log.Debug("HttpsProxy is running")
+	return
 }
+
 func (pxy *HttpsProxy) Close() {
+	if pxy.clientCtrl.svr.httpsMuxer == nil {
+		return
+	}
+	pxy.clientCtrl.svr.httpsMuxer.Remove(pxy.Domain, pxy)
+	log.Debug("httpsProxy is Closed")
+}
+
+type UdpProxy struct {
+	BaseProxy
+	RemotePort int
+	Encrypt    bool
+
+	udpConn *net.UDPConn
+	//发往客户端的数据包
+	sendCh  chan *msg.UdpPacket
+	closeCh chan struct{}
+	closed  bool
+	mu      sync.Mutex
+}
+
+func (pxy *UdpProxy) Run() (err error) {
+	pm := pxy.clientCtrl.svr.udpPortManager
+	port, err := pm.Acquire(pxy.Name, pxy.RemotePort, pxy.clientCtrl.policy().PortRanges())
+	if err != nil {
+		return
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", pxy.clientCtrl.svr.getConf().BindIP, port))
+	if err != nil {
+		pm.Release(port)
+		return
+	}
+	udpConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		pm.Release(port)
+		return
+	}
+
+	pxy.mu.Lock()
+	pxy.udpConn = udpConn
+	pxy.RemotePort = port
+	pxy.Msg.RemotePort = port
+	pxy.mu.Unlock()
+
+	go pxy.readUdp(udpConn)
+	go pxy.work()
+	log.Info("udp proxy [", pxy.Name, "] listen on ", addr)
+	return
+}
+
+//读取访问者发来的数据包，交给工作连接发送到客户端
+func (pxy *UdpProxy) readUdp(udpConn *net.UDPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, remoteAddr, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if !pxy.isClosed() {
+				log.Warn("udp proxy [", pxy.Name, "] read error:", err)
+			}
+			return
+		}
+
+		content := make([]byte, n)
+		copy(content, buf[:n])
+		pkt := &msg.UdpPacket{
+			Content:    content,
+			RemoteAddr: remoteAddr.String(),
+		}
+
+		select {
+		case pxy.sendCh <- pkt:
+		default:
+			log.Warn("udp proxy [", pxy.Name, "] send buffer is full, drop packet")
+		}
+	}
+}
+
+//保持一个工作连接，断开后重新获取
+func (pxy *UdpProxy) work() {
+	for {
+		workConn, err := pxy.GetWorkConn()
+		if pxy.isClosed() {
+			if err == nil {
+				workConn.Close()
+			}
+			return
+		}
+		if err != nil {
+			log.Error("udp proxy [", pxy.Name, "] get work connection error:", err)
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-pxy.closeCh:
+				return
+			}
+		}
+
+		pxy.serveWorkConn(workConn)
+	}
+}
+
+func (pxy *UdpProxy) serveWorkConn(workConn net.Conn) {
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			msgType, m, err := msg.ReadMsg(workConn)
+			if err != nil {
+				if !pxy.isClosed() {
+					log.Warn("udp proxy [", pxy.Name, "] read from work connection error:", err)
+				}
+				return
+			}
+			if msgType != msg.TypeUdpPacket {
+				continue
+			}
+
+			pkt := m.(*msg.UdpPacket)
+			remoteAddr, err := net.ResolveUDPAddr("udp", pkt.RemoteAddr)
+			if err != nil {
+				log.Warn("udp proxy [", pxy.Name, "] invalid remote address:", pkt.RemoteAddr)
+				continue
+			}
+			pxy.udpConn.WriteToUDP(pkt.Content, remoteAddr)
+		}
+	}()
+
+	defer workConn.Close()
+	for {
+		select {
+		case pkt := <-pxy.sendCh:
+			if err := msg.WriteMsg(msg.TypeUdpPacket, pkt, workConn); err != nil {
+				log.Warn("udp proxy [", pxy.Name, "] write to work connection error:", err)
+				return
+			}
+		case <-readDone:
+			return
+		case <-pxy.closeCh:
+			return
+		}
+	}
+}
+
+func (pxy *UdpProxy) isClosed() bool {
+	pxy.mu.Lock()
+	defer pxy.mu.Unlock()
+	return pxy.closed
+}
+
+func (pxy *UdpProxy) Close() {
+	pxy.mu.Lock()
+	defer pxy.mu.Unlock()
+
+	if pxy.closed {
+		return
+	}
+	pxy.closed = true
+	close(pxy.closeCh)
+	if pxy.udpConn != nil {
+		pxy.udpConn.Close()
+		pxy.clientCtrl.svr.udpPortManager.Release(pxy.RemotePort)
+	}
+	log.Debug("udp proxy [", pxy.Name, "] is closed")
 }
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"proxy/config"
+)
+
+const (
+	//检查用户token文件是否被修改的间隔
+	UserTokenCheckInterval time.Duration = 5 * time.Second
+)
+
+func (svr *Service) getConf() *config.ServerConfig {
+	svr.mu.RLock()
+	defer svr.mu.RUnlock()
+	return svr.conf
+}
+
+//返回用户的策略，没有配置时返回nil，表示不限制
+func (svr *Service) getUserPolicy(user string) *config.UserPolicy {
+	svr.mu.RLock()
+	defer svr.mu.RUnlock()
+	return svr.userPolicy.Get(user)
+}
+
+//返回用户登录和加密使用的密钥，文件中保存的是校验值时salt不为空
+func (svr *Service) getUserToken(user string) (token, salt string, ok bool) {
+	svr.mu.RLock()
+	defer svr.mu.RUnlock()
+	return svr.userToken.Lookup(user)
+}
+
+//重新加载配置文件、用户token文件和用户策略文件，任何一个文件有错误时保持原配置不变。
+//只有认证、心跳、端口范围、用户策略、管理接口的账号和http_proxy中除监听地址以外的配置可以在运行时修改，
+//token被删除或修改的用户会被断开，返回被断开的客户端id
+func (svr *Service) Reload() (kicked []string, err error) {
+	svr.reloadMu.Lock()
+	defer svr.reloadMu.Unlock()
+
+	oldConf := svr.getConf()
+
+	newConf := oldConf
+	if oldConf.ConfigFile != "" {
+		if newConf, err = config.NewServerConfWithFile(oldConf.ConfigFile); err != nil {
+			return nil, fmt.Errorf("reload config file error: %v", err)
+		}
+	}
+
+	allowPorts, err := config.ParsePortRanges(newConf.AllowPorts)
+	if err != nil {
+		return nil, fmt.Errorf("reload config file error: %v", err)
+	}
+	if oldConf.AdminAddr != "" {
+		if err = checkAdminAuth(newConf); err != nil {
+			return nil, fmt.Errorf("reload config file error: %v", err)
+		}
+	}
+
+	userToken := make(config.UserTokenMap)
+	if err = userToken.ReadUserTokenMap(newConf.UserTokenFile); err != nil {
+		return nil, fmt.Errorf("reload user token file error: %v", err)
+	}
+
+	userPolicy := make(config.UserPolicyMap)
+	if newConf.UserPolicyFile != "" {
+		if err = userPolicy.ReadUserPolicyMap(newConf.UserPolicyFile); err != nil {
+			return nil, fmt.Errorf("reload user policy file error: %v", err)
+		}
+	}
+
+	conf := mergeReloadableConf(oldConf, newConf)
+
+	svr.mu.Lock()
+	oldToken := svr.userToken
+	svr.conf = conf
+	svr.userToken = userToken
+	svr.userPolicy = userPolicy
+	svr.mu.Unlock()
+
+	svr.portManager.SetAllowPorts(allowPorts)
+	svr.udpPortManager.SetAllowPorts(allowPorts)
+	if svr.httpReverseProxy != nil && conf.HttpProxy != nil {
+		svr.httpReverseProxy.SetConf(conf.HttpProxy)
+	}
+
+	kicked = make([]string, 0)
+
+	for _, c := range svr.clientManager.List() {
+		user := c.loginMsg.User
+		if token, ok := userToken[user]; ok && token == oldToken[user] {
+			continue
+		}
+		log.Info("token of user [", user, "] is removed or changed, close client [", c.clientId, "]")
+		c.Close()
+		kicked = append(kicked, c.clientId)
+	}
+
+	log.Info("server config reloaded")
+	return kicked, nil
+}
+
+//在旧配置的基础上应用可以重新加载的配置项，其他配置项的修改需要重启才能生效
+func mergeReloadableConf(oldConf, newConf *config.ServerConfig) *config.ServerConfig {
+	conf := *oldConf
+	conf.UserTokenFile = newConf.UserTokenFile
+	conf.UserPolicyFile = newConf.UserPolicyFile
+	conf.AuthTimeout = newConf.AuthTimeout
+	conf.AuthLegacyMd5 = newConf.AuthLegacyMd5
+	conf.PingTimeout = newConf.PingTimeout
+	conf.AllowPorts = newConf.AllowPorts
+	conf.AdminUser = newConf.AdminUser
+	conf.AdminPwd = newConf.AdminPwd
+	conf.AdminToken = newConf.AdminToken
+
+	if newConf.BindIP != oldConf.BindIP || newConf.BindPort != oldConf.BindPort ||
+		newConf.TlsEnable != oldConf.TlsEnable || newConf.TlsOnly != oldConf.TlsOnly ||
+		newConf.TlsCertFile != oldConf.TlsCertFile || newConf.TlsKeyFile != oldConf.TlsKeyFile ||
+		newConf.TlsTrustedCaFile != oldConf.TlsTrustedCaFile || newConf.AdminAddr != oldConf.AdminAddr {
+		log.Warn("listen address and tls settings can not be reloaded, restart the server to apply them")
+	}
+	//http_proxy中除了监听地址都可以重新加载，复制一份以免修改旧配置
+	if oldConf.HttpProxy != nil && newConf.HttpProxy != nil {
+		httpProxy := *oldConf.HttpProxy
+		httpProxy.SubdomainHost = newConf.HttpProxy.SubdomainHost
+		httpProxy.MaxIdleConns = newConf.HttpProxy.MaxIdleConns
+		httpProxy.IdleTimeout = newConf.HttpProxy.IdleTimeout
+		httpProxy.TrustForwardedHeaders = newConf.HttpProxy.TrustForwardedHeaders
+		conf.HttpProxy = &httpProxy
+	}
+	if !sameHttpListen(oldConf, newConf) {
+		log.Warn("listen address of http_proxy and https_proxy can not be reloaded, restart the server to apply them")
+	}
+	return &conf
+}
+
+func sameHttpListen(oldConf, newConf *config.ServerConfig) bool {
+	if (oldConf.HttpProxy == nil) != (newConf.HttpProxy == nil) || (oldConf.HttpsProxy == nil) != (newConf.HttpsProxy == nil) {
+		return false
+	}
+	if oldConf.HttpProxy != nil &&
+		(oldConf.HttpProxy.VisitIP != newConf.HttpProxy.VisitIP || oldConf.HttpProxy.VisitPort != newConf.HttpProxy.VisitPort) {
+		return false
+	}
+	if oldConf.HttpsProxy != nil && *oldConf.HttpsProxy != *newConf.HttpsProxy {
+		return false
+	}
+	return true
+}
+
+//用户token文件被命令行工具修改后自动重新加载，服务关闭时退出
+func (svr *Service) watchUserTokenFile() {
+	var lastMod time.Time
+	if fi, err := os.Stat(svr.getConf().UserTokenFile); err == nil {
+		lastMod = fi.ModTime()
+	}
+
+	ticker := time.NewTicker(UserTokenCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-svr.closeCh:
+			return
+		}
+
+		fi, err := os.Stat(svr.getConf().UserTokenFile)
+		if err != nil || fi.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = fi.ModTime()
+
+		log.Info("user token file is modified, reload")
+		if _, err = svr.Reload(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+//在用户token文件上执行修改并立即生效，fn返回错误时不写入文件
+func (svr *Service) updateUserTokenMap(fn func(u config.UserTokenMap) error) error {
+	svr.userMu.Lock()
+	defer svr.userMu.Unlock()
+
+	if err := config.UpdateUserTokenFile(svr.getConf().UserTokenFile, fn); err != nil {
+		return err
+	}
+
+	_, err := svr.Reload()
+	return err
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"proxy/config"
+)
+
+const reloadTestConf = `
+bind_ip = "127.0.0.1"
+user_token_file = %q
+user_policy_file = %q
+ping_timeout = %d
+
+[http_proxy]
+visit_ip = "127.0.0.1"
+visit_port = %d
+subdomain_host = %q
+trust_forwarded_headers = %v
+`
+
+func writeTestFile(t *testing.T, file, data string) {
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//启动使用配置文件和用户策略文件的服务器
+func newReloadTestService(t *testing.T) *Service {
+	httpPort := freePort(t)
+	return newTestService(t, func(conf *config.ServerConfig) {
+		dir := filepath.Dir(conf.UserTokenFile)
+		conf.ConfigFile = filepath.Join(dir, "config.toml")
+		conf.UserPolicyFile = filepath.Join(dir, "policy.json")
+		conf.HttpProxy.VisitIP = "127.0.0.1"
+		conf.HttpProxy.VisitPort = httpPort
+		conf.HttpProxy.SubdomainHost = "old.example.com"
+		writeTestFile(t, conf.ConfigFile, fmt.Sprintf(reloadTestConf,
+			conf.UserTokenFile, conf.UserPolicyFile, conf.PingTimeout, httpPort, "old.example.com", false))
+		writeTestFile(t, conf.UserPolicyFile, `{"test": {"max_proxies": 5}}`)
+	})
+}
+
+//任何一个文件有错误时，重新加载失败，原配置和已登录的客户端保持不变
+func TestReloadMalformedFileKeepsConf(t *testing.T) {
+	svr := newReloadTestService(t)
+	localPort := newEchoServer(t)
+	newTestClient(t, svr, nil, &config.ProxyConf{Name: "echo", Type: "tcp", LocalIP: "127.0.0.1", LocalPort: localPort})
+	ctrl := waitProxies(t, svr, 1)
+
+	conf := svr.getConf()
+	files := map[string]string{
+		"config file": conf.ConfigFile,
+		"token file":  conf.UserTokenFile,
+		"policy file": conf.UserPolicyFile,
+	}
+	for name, file := range files {
+		old, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, file, "{not valid")
+
+		if _, err := svr.Reload(); err == nil {
+			t.Fatalf("%s: reload malformed file succeeded", name)
+		}
+		if svr.getConf() != conf {
+			t.Fatalf("%s: config is replaced", name)
+		}
+		if _, _, ok := svr.getUserToken(testUser); !ok {
+			t.Fatalf("%s: user token is lost", name)
+		}
+		if p := svr.getUserPolicy(testUser); p == nil || p.MaxProxies != 5 {
+			t.Fatalf("%s: user policy is lost: %+v", name, p)
+		}
+		if c, ok := svr.clientManager.Get(ctrl.clientId); !ok || c != ctrl {
+			t.Fatalf("%s: client is kicked", name)
+		}
+
+		writeTestFile(t, file, string(old))
+	}
+
+	//文件恢复后可以正常加载
+	kicked, err := svr.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kicked) != 0 {
+		t.Fatal("unchanged user is kicked:", kicked)
+	}
+}
+
+func TestReloadHttpProxyConf(t *testing.T) {
+	svr := newReloadTestService(t)
+	oldConf := svr.getConf()
+	writeTestFile(t, oldConf.ConfigFile, fmt.Sprintf(reloadTestConf,
+		oldConf.UserTokenFile, oldConf.UserPolicyFile, oldConf.PingTimeout, oldConf.HttpProxy.VisitPort, "new.example.com", true))
+
+	if _, err := svr.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	conf := svr.getConf()
+	if conf.HttpProxy.SubdomainHost != "new.example.com" {
+		t.Fatal("subdomain_host is not reloaded:", conf.HttpProxy.SubdomainHost)
+	}
+	if oldConf.HttpProxy.SubdomainHost != "old.example.com" {
+		t.Fatal("old config is modified")
+	}
+	if !svr.httpReverseProxy.trustForwarded {
+		t.Fatal("trust_forwarded_headers is not reloaded")
+	}
+
+	//新注册的代理使用新的subdomain_host
+	newTestClient(t, svr, nil, &config.ProxyConf{Name: "web", Type: "http", LocalIP: "127.0.0.1", LocalPort: newHttpServer(t, "ok"), Subdomain: "foo"})
+	ctrl := waitProxies(t, svr, 1)
+	if domain := getProxy(t, ctrl, "web").GetMsg().Domain; domain != "foo.new.example.com" {
+		t.Fatal("domain =", domain)
+	}
+}
+
+//并发修改token文件和重新加载时，最后加载的是文件的最新内容
+func TestReloadConcurrent(t *testing.T) {
+	svr := newReloadTestService(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		user := fmt.Sprintf("user%d", i)
+		go func() {
+			defer wg.Done()
+			err := svr.updateUserTokenMap(func(u config.UserTokenMap) error {
+				u[user] = "token"
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := svr.Reload(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		if _, _, ok := svr.getUserToken(fmt.Sprintf("user%d", i)); !ok {
+			t.Fatalf("user%d is lost after concurrent reload", i)
+		}
+	}
+}
+
+//服务关闭后token文件的监视goroutine退出
+func TestServiceCloseStopsTokenWatcher(t *testing.T) {
+	svr := newTestService(t, nil)
+	waitFor(t, 5*time.Second, "token watcher start", func() bool { return strings.Contains(goroutineDump(), "watchUserTokenFile") })
+
+	svr.Close()
+	svr.Close()
+	waitFor(t, 5*time.Second, "token watcher exit", func() bool { return !strings.Contains(goroutineDump(), "watchUserTokenFile") })
+	if _, err := net.Dial("tcp", svr.listener.Addr().String()); err == nil {
+		t.Fatal("listener is not closed")
+	}
+}
@@ -1,13 +1,17 @@
 package server
 
 import (
+	"fmt"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
 
 	log "github.com/cihub/seelog"
+	msg "proxy/message"
 )
 
+//map的key为小写的域名，可以是 *.example.com 形式的泛域名
 type Routers struct {
 	RouterMap map[string][]*router
 
@@ -18,7 +22,8 @@ type router struct {
 	domain string
 	url    string
 
-	pxy Proxy
+	//没有配置分组的代理独占该路由
+	group *ProxyGroup
 }
 
 func NewRouters() *Routers {
@@ -27,7 +32,11 @@ func NewRouters() *Routers {
 	}
 }
 
-func (Rs *Routers) Add(domain, url string, pxy Proxy) {
+//添加路由，相同的域名和url已经存在时，同一分组的代理加入该路由的分组，否则返回已有的路由
+func (Rs *Routers) Add(domain, url string, pxy Proxy) (exist *router, err error) {
+	domain = strings.ToLower(domain)
+	m := pxy.GetMsg()
+
 	Rs.mu.Lock()
 	defer Rs.mu.Unlock()
 
@@ -36,20 +45,33 @@ func (Rs *Routers) Add(domain, url string, pxy Proxy) {
 	if !ok {
 		rs = make([]*router, 0, 1)
 	}
+	for _, r := range rs {
+		if r.url == url {
+			if m.Group == "" || m.Group != r.group.Name() {
+				return r, nil
+			}
+			return nil, r.group.Join(pxy)
+		}
+	}
 
 	r := &router{
 		domain: domain,
 		url:    url,
-		pxy:    pxy,
+		group:  NewProxyGroup(m.Group, m.GroupKey, m.LoadBalance),
 	}
+	r.group.Join(pxy)
 
 	rs = append(rs, r)
 	sort.Sort(sort.Reverse(ByUrl(rs)))
 	log.Debug("router:", r)
 	Rs.RouterMap[domain] = rs
+	return nil, nil
 }
 
-func (Rs *Routers) Del(domain, url string) {
+//代理离开路由，路由没有代理时删除
+func (Rs *Routers) Del(domain, url string, pxy Proxy) {
+	domain = strings.ToLower(domain)
+
 	Rs.mu.Lock()
 	defer Rs.mu.Unlock()
 
@@ -60,38 +82,56 @@ func (Rs *Routers) Del(domain, url string) {
 
 	for i, r := range rs {
 		if r.url == url {
+			if !r.group.Leave(pxy) {
+				return
+			}
 			if len(rs) > i+1 {
 				Rs.RouterMap[domain] = append(rs[:i], rs[i+1:]...)
 			} else {
 				Rs.RouterMap[domain] = rs[:i]
 			}
+			if len(Rs.RouterMap[domain]) == 0 {
+				delete(Rs.RouterMap, domain)
+			}
 			return
 		}
 	}
 }
 
+//先匹配完整域名，再从长到短匹配泛域名，例如 a.b.example.com 依次匹配
+//a.b.example.com、*.b.example.com、*.example.com、*.com
 func (Rs *Routers) Get(domain, url string) *router {
 	Rs.mu.RLock()
 	defer Rs.mu.RUnlock()
 
-	rs, ok := Rs.RouterMap[domain]
-	if !ok {
-		return nil
+	for _, d := range matchDomains(strings.ToLower(domain)) {
+		for _, r := range Rs.RouterMap[d] {
+			if strings.HasPrefix(url, r.url) {
+				return r
+			}
+		}
 	}
+	return nil
+}
 
-	for _, r := range rs {
-		if strings.HasPrefix(url, r.url) {
-			return r
+func matchDomains(domain string) []string {
+	domains := []string{domain}
+	for {
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
 		}
+		domain = domain[i+1:]
+		domains = append(domains, "*."+domain)
 	}
-	return nil
+	return domains
 }
 
 func (Rs *Routers) Find(domain, url string) *router {
 	Rs.mu.RLock()
 	defer Rs.mu.RUnlock()
 
-	rs, ok := Rs.RouterMap[domain]
+	rs, ok := Rs.RouterMap[strings.ToLower(domain)]
 	if !ok {
 		return nil
 	}
@@ -105,6 +145,84 @@ func (Rs *Routers) Find(domain, url string) *router {
 
 }
 
+//校验http代理的域名，泛域名只能以 *. 开头
+func checkDomain(domain string) error {
+	if domain == "" {
+		return fmt.Errorf("domain is empty")
+	}
+	name := strings.TrimPrefix(domain, "*.")
+	if name == "" || strings.Contains(name, "*") {
+		return fmt.Errorf("invalid domain [%s], only a leading *. is allowed for wildcard domains", domain)
+	}
+	return nil
+}
+
+var subdomainRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+//http代理配置了subdomain时，使用 subdomain.<subdomain_host> 作为域名
+func (svr *Service) resolveDomain(m *msg.NewProxy) error {
+	if m.Subdomain == "" {
+		return nil
+	}
+	if m.ProxyType != "http" {
+		return fmt.Errorf("subdomain is only supported for http proxy")
+	}
+	if m.Domain != "" {
+		return fmt.Errorf("domain and subdomain can not be set at the same time")
+	}
+
+	conf := svr.getConf()
+	if conf.HttpProxy == nil || conf.HttpProxy.SubdomainHost == "" {
+		return fmt.Errorf("subdomain is not supported, subdomain_host is not configured on server")
+	}
+
+	subdomain := strings.ToLower(m.Subdomain)
+	if !subdomainRegexp.MatchString(subdomain) {
+		return fmt.Errorf("invalid subdomain [%s]", m.Subdomain)
+	}
+	m.Domain = subdomain + "." + strings.ToLower(conf.HttpProxy.SubdomainHost)
+	return nil
+}
+
+//选择处理本次请求的代理
+func (r *router) pick(clientIP string) Proxy {
+	return r.group.Pick(clientIP)
+}
+
+type RouterInfo struct {
+	Domain      string `json:"domain"`
+	Url         string `json:"url"`
+	ProxyName   string `json:"proxy_name"`
+	ClientId    string `json:"client_id"`
+	Group       string `json:"group,omitempty"`
+	LoadBalance string `json:"load_balance,omitempty"`
+}
+
+func (Rs *Routers) List() []RouterInfo {
+	Rs.mu.RLock()
+	defer Rs.mu.RUnlock()
+
+	list := make([]RouterInfo, 0, len(Rs.RouterMap))
+	for _, rs := range Rs.RouterMap {
+		for _, r := range rs {
+			info := RouterInfo{
+				Domain: r.domain,
+				Url:    r.url,
+				Group:  r.group.Name(),
+			}
+			if info.Group != "" {
+				info.LoadBalance = r.group.Strategy()
+			}
+			for _, pxy := range r.group.Members() {
+				info.ProxyName = pxy.GetName()
+				info.ClientId = pxy.GetClient().clientId
+				list = append(list, info)
+			}
+		}
+	}
+	return list
+}
+
 type ByUrl []*router
 
 func (r ByUrl) Len() int {
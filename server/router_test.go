@@ -0,0 +1,146 @@
+package server
+
+import (
+	"testing"
+
+	"proxy/config"
+	msg "proxy/message"
+)
+
+//不连接客户端的http代理，只用于路由和分组
+func newRouteProxy(t *testing.T, name string, m msg.NewProxy) Proxy {
+	m.ProxyName = name
+	if m.ProxyType == "" {
+		m.ProxyType = "http"
+	}
+	pxy, err := NewProxy(&ClientCtrl{clientId: "client-" + name}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pxy
+}
+
+func TestRoutersGet(t *testing.T) {
+	Rs := NewRouters()
+	routes := []struct {
+		name   string
+		domain string
+		url    string
+	}{
+		{"root", "example.com", "/"},
+		{"wild", "*.example.com", "/"},
+		{"wild-static", "*.example.com", "/static"},
+		{"wild-b", "*.B.example.com", "/"},
+		{"exact-a", "A.example.com", "/"},
+		{"exact-a-api", "a.example.com", "/api"},
+	}
+	proxies := make(map[string]Proxy)
+	for _, r := range routes {
+		pxy := newRouteProxy(t, r.name, msg.NewProxy{})
+		proxies[r.name] = pxy
+		if exist, err := Rs.Add(r.domain, r.url, pxy); exist != nil || err != nil {
+			t.Fatalf("add %s%s: %v, %v", r.domain, r.url, exist, err)
+		}
+	}
+
+	cases := []struct {
+		host string
+		url  string
+		want string
+	}{
+		//完整域名优先于泛域名，即使泛域名的url更长
+		{"a.example.com", "/", "exact-a"},
+		{"A.EXAMPLE.COM", "/index.html", "exact-a"},
+		{"a.example.com", "/api/users", "exact-a-api"},
+		{"a.example.com", "/static/app.js", "exact-a"},
+		//泛域名按url最长前缀匹配
+		{"c.example.com", "/", "wild"},
+		{"c.example.com", "/static/app.js", "wild-static"},
+		{"x.y.example.com", "/", "wild"},
+		//更长的泛域名优先
+		{"x.b.example.com", "/", "wild-b"},
+		{"x.y.b.example.com", "/static", "wild-b"},
+		//*.b.example.com 不匹配 b.example.com 本身
+		{"b.example.com", "/", "wild"},
+		{"example.com", "/", "root"},
+		{"other.com", "/", ""},
+		{"badexample.com", "/", ""},
+		{"example.com.other.com", "/", ""},
+	}
+	for _, c := range cases {
+		r := Rs.Get(c.host, c.url)
+		got := ""
+		if r != nil {
+			got = r.pick("").GetName()
+		}
+		if got != c.want {
+			t.Errorf("Get(%q, %q) = %q, want %q", c.host, c.url, got, c.want)
+		}
+	}
+
+	//完整域名的路由删除后由泛域名处理
+	Rs.Del("a.example.com", "/", proxies["exact-a"])
+	if r := Rs.Get("a.example.com", "/"); r == nil || r.pick("").GetName() != "wild" {
+		t.Fatal("deleted route is still used:", r)
+	}
+	if r := Rs.Get("a.example.com", "/api"); r == nil || r.pick("").GetName() != "exact-a-api" {
+		t.Fatal("other url of the domain is lost:", r)
+	}
+
+	//相同的域名和url已被其他代理使用
+	if exist, _ := Rs.Add("*.EXAMPLE.com", "/", newRouteProxy(t, "dup", msg.NewProxy{})); exist == nil || exist.pick("") != proxies["wild"] {
+		t.Fatal("duplicate route is added")
+	}
+}
+
+func TestCheckDomain(t *testing.T) {
+	cases := map[string]bool{
+		"example.com":     true,
+		"*.example.com":   true,
+		"a.b.example.com": true,
+		"":                false,
+		"*.":              false,
+		"*":               false,
+		"a.*.example.com": false,
+		"*.*.example.com": false,
+		"*example.com":    false,
+	}
+	for domain, ok := range cases {
+		if err := checkDomain(domain); (err == nil) != ok {
+			t.Errorf("checkDomain(%q) = %v, want ok %v", domain, err, ok)
+		}
+	}
+}
+
+func TestResolveDomain(t *testing.T) {
+	svr := &Service{conf: &config.ServerConfig{HttpProxy: &config.HttpProxyConf{SubdomainHost: "Example.com"}}}
+	cases := []struct {
+		m      msg.NewProxy
+		domain string
+		ok     bool
+	}{
+		{msg.NewProxy{ProxyType: "http", Subdomain: "foo"}, "foo.example.com", true},
+		{msg.NewProxy{ProxyType: "http", Subdomain: "Foo.Bar-1"}, "foo.bar-1.example.com", true},
+		//没有subdomain时不修改domain
+		{msg.NewProxy{ProxyType: "http", Domain: "www.other.com"}, "www.other.com", true},
+		{msg.NewProxy{ProxyType: "https", Subdomain: "foo"}, "", false},
+		{msg.NewProxy{ProxyType: "http", Subdomain: "foo", Domain: "www.other.com"}, "www.other.com", false},
+		{msg.NewProxy{ProxyType: "http", Subdomain: "-foo"}, "", false},
+		{msg.NewProxy{ProxyType: "http", Subdomain: "foo_bar"}, "", false},
+		{msg.NewProxy{ProxyType: "http", Subdomain: "*.foo"}, "", false},
+		{msg.NewProxy{ProxyType: "http", Subdomain: "foo..bar"}, "", false},
+	}
+	for _, c := range cases {
+		m := c.m
+		err := svr.resolveDomain(&m)
+		if (err == nil) != c.ok || m.Domain != c.domain {
+			t.Errorf("resolveDomain(%+v) = %q, %v", c.m, m.Domain, err)
+		}
+	}
+
+	//服务器没有配置subdomain_host
+	svr.conf = &config.ServerConfig{HttpProxy: &config.HttpProxyConf{}}
+	if err := svr.resolveDomain(&msg.NewProxy{ProxyType: "http", Subdomain: "foo"}); err == nil {
+		t.Fatal("subdomain is resolved without subdomain_host")
+	}
+}
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -19,6 +21,9 @@ const (
 type Service struct {
 	//接受所有客户端的连接
 	listener net.Listener
+	//http反向代理和管理接口的监听，Close时一起关闭
+	httpListener  net.Listener
+	adminListener net.Listener
 
 	conf *config.ServerConfig
 
@@ -28,25 +33,79 @@ type Service struct {
 	//管理所有代理
 	proxyManager *ProxyManager
 
+	//管理tcp和udp代理的远程端口
+	portManager    *PortManager
+	udpPortManager *PortManager
+
+	//共享端口的tcp代理分组
+	tcpGroups *TcpGroupManager
+
 	//http反向代理
 	httpReverseProxy *HttpReverseProxy
 
-	userToken config.UserTokenMap
+	//根据SNI转发https连接
+	httpsMuxer *HttpsMuxer
+
+	userToken  config.UserTokenMap
+	userPolicy config.UserPolicyMap
+
+	//为空时不接受tls连接
+	tlsConfig *tls.Config
+
+	//最近登录使用过的签名
+	signCache *SignCache
+
+	//保护conf、userToken和userPolicy，重新加载配置时整体替换
+	mu sync.RWMutex
+	//管理接口修改用户token文件时加锁
+	userMu sync.Mutex
+	//SIGHUP、管理接口和token文件监视可能同时重新加载，整个过程加锁
+	reloadMu sync.Mutex
+	//注册受max_proxies限制的代理时，统计数量和加入代理表之间加锁
+	policyMu sync.Mutex
+
+	//Close时关闭，通知后台的goroutine退出
+	closeCh   chan struct{}
+	closeOnce sync.Once
 }
 
 func NewService(conf *config.ServerConfig) (svr *Service, err error) {
+	allowPorts, err := config.ParsePortRanges(conf.AllowPorts)
+	if err != nil {
+		return nil, err
+	}
+
 	svr = &Service{
-		conf:          conf,
-		clientManager: NewClientManager(),
-		proxyManager:  NewProxyManager(),
-		userToken:     make(map[string]string),
+		conf:           conf,
+		clientManager:  NewClientManager(),
+		proxyManager:   NewProxyManager(),
+		portManager:    NewPortManager("tcp", allowPorts),
+		udpPortManager: NewPortManager("udp", allowPorts),
+		userToken:      make(map[string]string),
+		userPolicy:     make(config.UserPolicyMap),
+		signCache:      NewSignCache(),
+		closeCh:        make(chan struct{}),
+	}
+	svr.tcpGroups = NewTcpGroupManager(svr)
+
+	if conf.TlsEnable {
+		svr.tlsConfig, err = utils.NewServerTLSConfig(conf.TlsCertFile, conf.TlsKeyFile, conf.TlsTrustedCaFile)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	err = svr.userToken.ReadUserTokenMap(conf.UserTokenFile)
 	if err != nil {
 		return nil, err
 	}
-	log.Debug(svr.userToken)
+	log.Debug(svr.userToken.Users())
+
+	if conf.UserPolicyFile != "" {
+		if err = svr.userPolicy.ReadUserPolicyMap(conf.UserPolicyFile); err != nil {
+			return nil, err
+		}
+	}
 
 	tcp_addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", conf.BindIP, conf.BindPort))
 	if err != nil {
@@ -58,7 +117,7 @@ func NewService(conf *config.ServerConfig) (svr *Service, err error) {
 	}
 
 	if conf.HttpProxy.VisitPort > 0 {
-		hp := NewHttpReverseProxy()
+		hp := NewHttpReverseProxy(conf.HttpProxy)
 		svr.httpReverseProxy = hp
 		addr := fmt.Sprintf("%s:%d", conf.HttpProxy.VisitIP, conf.HttpProxy.VisitPort)
 
@@ -68,6 +127,7 @@ func NewService(conf *config.ServerConfig) (svr *Service, err error) {
 			log.Error("Creat http reverse proxy error:", err)
 			return
 		}
+		svr.httpListener = l
 
 		Server := &http.Server{
 			Addr:    addr,
@@ -77,11 +137,46 @@ func NewService(conf *config.ServerConfig) (svr *Service, err error) {
 		log.Info("http reverse proxy start")
 	}
 
+	if conf.HttpsProxy != nil && conf.HttpsProxy.VisitPort > 0 {
+		addr := fmt.Sprintf("%s:%d", conf.HttpsProxy.VisitIP, conf.HttpsProxy.VisitPort)
+
+		var l net.Listener
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			log.Error("Creat https muxer error:", err)
+			return
+		}
+
+		svr.httpsMuxer = NewHttpsMuxer(l)
+		go svr.httpsMuxer.Run()
+		log.Info("https muxer start")
+	}
+
+	if conf.AdminAddr != "" {
+		var as *AdminServer
+		as, err = NewAdminServer(svr)
+		if err != nil {
+			return nil, err
+		}
+
+		var l net.Listener
+		l, err = net.Listen("tcp", conf.AdminAddr)
+		if err != nil {
+			log.Error("Creat admin server error:", err)
+			return
+		}
+		svr.adminListener = l
+		go as.Run(l)
+		log.Info("admin server listen on ", conf.AdminAddr)
+	}
+
 	log.Debug("NewService")
 	return
 }
 
 func (svr *Service) Run() {
+	go svr.watchUserTokenFile()
+
 	l := svr.listener
 	for {
 		conn, err := l.Accept()
@@ -90,86 +185,160 @@ func (svr *Service) Run() {
 			return
 		}
 
-		go func(conn *net.TCPConn) {
-			conn.SetReadDeadline(time.Now().Add(ReadTimeout))
-			msgType, m, err := msg.ReadMsg(conn)
-			log.Debug("receive  msg")
-			if err != nil {
-				conn.Close()
-				return
-			}
-			conn.SetReadDeadline(time.Time{})
-
-			switch msgType {
-			case msg.TypeLogin:
-				log.Debug("receive login msg")
-				err = svr.RegisterClient(conn, m.(*msg.Login))
-				if err != nil {
-					log.Error(err)
-					loginResp := msg.LoginResp{
-						Error: fmt.Sprintf("%v", err),
-					}
-					msg.WriteMsg(msg.TypeLoginResp, loginResp, conn)
-					conn.Close()
-					return
-				}
-				log.Debug("RegisterClient success")
-
-			case msg.TypeNewWorkConn:
-				log.Debug("newworkconn")
-				c, ok := svr.clientManager.Client[m.(*msg.NewWorkConn).ClientId]
-				if ok {
-					c.NewWorkConn(conn)
-				} else {
-					log.Warn("receive work connection,but not found client:", m.(*msg.NewWorkConn).ClientId)
-					conn.Close()
-				}
-			default:
-				conn.Close()
+		go svr.handleConn(conn)
+	}
 
-			}
+}
 
-		}(conn.(*net.TCPConn))
+//停止接受新的连接并结束后台的goroutine，Run随之返回，已登录的客户端不受影响
+func (svr *Service) Close() {
+	svr.closeOnce.Do(func() {
+		close(svr.closeCh)
+		svr.listener.Close()
+		if svr.httpListener != nil {
+			svr.httpListener.Close()
+		}
+		if svr.httpsMuxer != nil {
+			svr.httpsMuxer.listener.Close()
+		}
+		if svr.adminListener != nil {
+			svr.adminListener.Close()
+		}
+	})
+}
 
+func (svr *Service) handleConn(conn net.Conn) {
+	_, isTls := conn.(*tls.Conn)
+	//多路复用的流已经在会话中完成了tls校验
+	stream, isStream := conn.(*utils.Stream)
+	var session *utils.Session
+	if isStream {
+		session = stream.Session()
 	}
 
-}
+	conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+	first, conn, err := utils.PeekByte(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
 
-func (svr *Service) RegisterClient(conn *net.TCPConn, loginMsg *msg.Login) (err error) {
-	now := time.Now().Unix()
-	if svr.conf.AuthTimeout != 0 && now-loginMsg.Timestamp > svr.conf.AuthTimeout {
-		err = fmt.Errorf("Authorization Error: Timeout")
+	if first == utils.TlsHandshakeByte && !isTls {
+		svr.handleTlsConn(conn)
 		return
 	}
 
-	var token string
-	var ok bool
-	if token, ok = svr.userToken[loginMsg.User]; !ok {
-		err = fmt.Errorf("Authorization Error: This user does not exist")
+	if conf := svr.getConf(); conf.TlsEnable && conf.TlsOnly && !isTls && !isStream {
+		log.Warn("reject plaintext connection from ", conn.RemoteAddr())
+		conn.Close()
 		return
 	}
-	_, sign := utils.GetMD5([]byte(fmt.Sprintf("%s%d", token, loginMsg.Timestamp)))
-	log.Debug(loginMsg.Sign)
-	if string(sign) != loginMsg.Sign {
-		err = fmt.Errorf("Authorization Error: Token error")
+
+	if first == utils.MuxVersion {
+		conn.SetReadDeadline(time.Time{})
+		svr.handleMuxConn(conn)
 		return
 	}
 
-	if loginMsg.ClientId == "" {
-		loginMsg.ClientId, err = utils.GetClientId()
+	msgType, m, err := msg.ReadMsg(conn)
+	log.Debug("receive  msg")
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch msgType {
+	case msg.TypeLogin:
+		log.Debug("receive login msg")
+		err = svr.RegisterClient(conn, m.(*msg.Login), session)
+		if err != nil {
+			log.Error(err)
+			loginResp := msg.LoginResp{
+				Error: fmt.Sprintf("%v", err),
+			}
+			msg.WriteMsg(msg.TypeLoginResp, loginResp, conn)
+			conn.Close()
+			return
+		}
+		log.Debug("RegisterClient success")
+
+	case msg.TypeNewWorkConn:
+		log.Debug("newworkconn")
+		c, ok := svr.clientManager.Get(m.(*msg.NewWorkConn).ClientId)
+		if ok {
+			c.NewWorkConn(conn)
+		} else {
+			log.Warn("receive work connection,but not found client:", m.(*msg.NewWorkConn).ClientId)
+			conn.Close()
+		}
+	default:
+		conn.Close()
+
+	}
+}
+
+func (svr *Service) handleTlsConn(conn net.Conn) {
+	if svr.tlsConfig == nil {
+		log.Warn("receive tls connection from ", conn.RemoteAddr(), ",but tls is not enabled")
+		conn.Close()
+		return
+	}
+
+	tlsConn := tls.Server(conn, svr.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Warn("tls handshake with ", conn.RemoteAddr(), " error:", err)
+		conn.Close()
+		return
+	}
+	svr.handleConn(tlsConn)
+}
+
+//多路复用模式下，每个逻辑流都相当于一个新的tcp连接
+func (svr *Service) handleMuxConn(conn net.Conn) {
+	log.Debug("accept mux session from ", conn.RemoteAddr())
+	session := utils.NewSession(conn, false)
+	for {
+		stream, err := session.Accept()
 		if err != nil {
+			log.Debug("mux session closed:", err)
 			return
 		}
+		go svr.handleConn(stream)
 	}
-	if _, ok := svr.clientManager.Client[loginMsg.ClientId]; ok {
+}
+
+//控制连接是多路复用中的流时，session为所在的会话，客户端断开时一起关闭
+func (svr *Service) RegisterClient(conn net.Conn, loginMsg *msg.Login, session *utils.Session) (err error) {
+	token, err := svr.authenticate(conn, loginMsg)
+	if err != nil {
+		return
+	}
+
+	//新客户端分配一个未使用的id
+	for loginMsg.ClientId == "" {
 		loginMsg.ClientId, err = utils.GetClientId()
 		if err != nil {
 			return
 		}
+		if _, ok := svr.clientManager.Get(loginMsg.ClientId); ok {
+			loginMsg.ClientId = ""
+		}
 	}
 
 	clientCtrl := NewClientCtrl(svr, loginMsg, conn, token)
-	svr.clientManager.Add(loginMsg.ClientId, clientCtrl)
+	clientCtrl.session = session
+	old, err := svr.clientManager.Add(loginMsg.ClientId, clientCtrl)
+	if err != nil {
+		return
+	}
+
+	//同一用户使用旧的id重新登录，关闭旧的连接并释放它的代理和端口，代理不会转移到新连接，
+	//由客户端登录后重新注册，见客户端配置文件中token的说明
+	if old != nil {
+		log.Info("client [", loginMsg.ClientId, "] login again, close the old session")
+		old.Close()
+	}
 
 	clientCtrl.Start()
 
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"proxy/config"
+)
+
+func TestTcpProxyEndToEnd(t *testing.T) {
+	svr := newTestService(t, nil)
+	localPort := newEchoServer(t)
+	newTestClient(t, svr, nil, &config.ProxyConf{
+		Name:      "echo",
+		Type:      "tcp",
+		LocalIP:   "127.0.0.1",
+		LocalPort: localPort,
+	})
+
+	ctrl := waitProxies(t, svr, 1)
+	pxy := getProxy(t, ctrl, "echo").(*TcpProxy)
+	addr := fmt.Sprintf("127.0.0.1:%d", pxy.GetMsg().RemotePort)
+
+	//多个并发连接各自独立转发
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoRoundTrip(t, conn, []byte(fmt.Sprintf("hello %d", i)))
+		echoRoundTrip(t, conn, bytes.Repeat([]byte{byte(i)}, 256*1024))
+		conn.Close()
+	}
+
+	ctrl.Close()
+	if c, ok := svr.clientManager.Get(ctrl.clientId); ok && c == ctrl {
+		t.Fatal("client is still registered after Close")
+	}
+	//监听已关闭时Accept立即返回错误，而不是超时
+	l := pxy.listener.(*net.TCPListener)
+	l.SetDeadline(time.Now().Add(time.Second))
+	if _, err := l.Accept(); err == nil || !errors.Is(err, net.ErrClosed) {
+		t.Fatal("remote listener is still open after ClientCtrl.Close:", err)
+	}
+}
+
+//多路复用模式下，服务器关闭客户端时整个会话一起关闭
+func TestMuxClientCloseSession(t *testing.T) {
+	svr := newTestService(t, nil)
+	localPort := newEchoServer(t)
+	newTestClient(t, svr, func(conf *config.ClientConfig) {
+		conf.Mux = true
+	}, &config.ProxyConf{
+		Name:      "echo",
+		Type:      "tcp",
+		LocalIP:   "127.0.0.1",
+		LocalPort: localPort,
+	})
+
+	ctrl := waitProxies(t, svr, 1)
+	if ctrl.session == nil {
+		t.Fatal("mux client has no session")
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", getProxy(t, ctrl, "echo").GetMsg().RemotePort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoRoundTrip(t, conn, []byte("over mux"))
+
+	ctrl.Close()
+	if !ctrl.session.IsClosed() {
+		t.Fatal("mux session is still open after ClientCtrl.Close")
+	}
+}
+
+func TestEncryptedTcpProxy(t *testing.T) {
+	svr := newTestService(t, nil)
+	localPort := newEchoServer(t)
+	newTestClient(t, svr, nil, &config.ProxyConf{
+		Name:             "echo",
+		Type:             "tcp",
+		Encryption:       true,
+		EncryptionMethod: "aes-gcm",
+		LocalIP:          "127.0.0.1",
+		LocalPort:        localPort,
+	})
+
+	ctrl := waitProxies(t, svr, 1)
+	addr := fmt.Sprintf("127.0.0.1:%d", getProxy(t, ctrl, "echo").GetMsg().RemotePort)
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoRoundTrip(t, conn, bytes.Repeat([]byte("encrypted"), 10000))
+
+		//本地服务关闭连接时，访问者一侧也被关闭
+		conn.(*net.TCPConn).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("connection is not closed")
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("connection is not closed")
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"proxy/config"
+)
+
+//多个访问者通过同一个远程端口收发数据，各自收到自己的回复
+func TestUdpProxyEndToEnd(t *testing.T) {
+	svr := newTestService(t, nil)
+	newTestClient(t, svr, nil, &config.ProxyConf{
+		Name:      "udp",
+		Type:      "udp",
+		LocalIP:   "127.0.0.1",
+		LocalPort: newUdpEchoServer(t),
+	})
+	ctrl := waitProxies(t, svr, 1)
+	addr := fmt.Sprintf("127.0.0.1:%d", getProxy(t, ctrl, "udp").GetMsg().RemotePort)
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	buf := make([]byte, 2048)
+	for round := 0; round < 3; round++ {
+		for i, conn := range conns {
+			data := fmt.Sprintf("visitor %d round %d", i, round)
+			//工作连接建立前的数据包可能被丢弃，超时后重发
+			waitFor(t, 5*time.Second, "udp reply", func() bool {
+				conn.Write([]byte(data))
+				conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				n, err := conn.Read(buf)
+				return err == nil && string(buf[:n]) == data
+			})
+		}
+	}
+}
@@ -7,38 +7,103 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
+	"proxy/config"
+	"proxy/utils"
 )
 
 const (
 	responseHeaderTimeout = time.Duration(30) * time.Second
+
+	defaultMaxIdleConns = 16
+	defaultIdleTimeout  = time.Duration(60) * time.Second
 )
 
 type HttpReverseProxy struct {
-	router    *Routers
-	Transport http.RoundTripper
+	router *Routers
+
+	//每个代理保持的空闲工作连接数和空闲时间
+	maxIdleConns int
+	idleTimeout  time.Duration
+
+	trustForwarded bool
+
+	//重新加载配置时修改上面的配置项
+	mu sync.RWMutex
 }
 
-func NewHttpReverseProxy() (rp *HttpReverseProxy) {
+func NewHttpReverseProxy(conf *config.HttpProxyConf) (rp *HttpReverseProxy) {
 	rp = &HttpReverseProxy{
 		router: NewRouters(),
 	}
-	Transport := &http.Transport{
+	rp.SetConf(conf)
+	return
+}
+
+//更新连接池和转发头部的配置，连接池的配置只对之后注册的代理生效
+func (hp *HttpReverseProxy) SetConf(conf *config.HttpProxyConf) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	hp.maxIdleConns = defaultMaxIdleConns
+	if conf.MaxIdleConns != 0 {
+		hp.maxIdleConns = conf.MaxIdleConns
+	}
+	hp.idleTimeout = defaultIdleTimeout
+	if conf.IdleTimeout > 0 {
+		hp.idleTimeout = time.Duration(conf.IdleTimeout) * time.Second
+	}
+	hp.trustForwarded = conf.TrustForwardedHeaders
+}
+
+//每个代理使用独立的连接池，工作连接在请求之间复用，代理关闭时清空连接池
+func (hp *HttpReverseProxy) NewTransport(pxy Proxy) *http.Transport {
+	hp.mu.RLock()
+	maxIdleConns, idleTimeout := hp.maxIdleConns, hp.idleTimeout
+	hp.mu.RUnlock()
+
+	transport := &http.Transport{
 		ResponseHeaderTimeout: responseHeaderTimeout,
-		DisableKeepAlives:     true,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConns,
+		IdleConnTimeout:       idleTimeout,
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			url := ctx.Value("url").(string)
-			host := getHostFromAddr(ctx.Value("host").(string))
-			return rp.GetConn(host, url)
+			return getWorkConnContext(ctx, pxy)
 		},
 	}
+	//max_idle_conns小于0时不复用连接
+	if maxIdleConns < 0 {
+		transport.DisableKeepAlives = true
+	}
+	return transport
+}
 
-	rp.Transport = Transport
-
-	return
-
+//请求被取消时立即返回，之后取到的工作连接直接关闭
+func getWorkConnContext(ctx context.Context, pxy Proxy) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := pxy.GetWorkConn()
+		ch <- result{conn, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
 }
 
 func (hp *HttpReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -74,15 +139,42 @@ func (hp *HttpReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	url := clientReq.Context().Value("url").(string)
 	host := getHostFromAddr(clientReq.Context().Value("host").(string))
 	log.Debug("76[", host, ":", url, "]")
-	host = hp.GetRealHost(host, url)
+	clientIP, _, _ := net.SplitHostPort(req.RemoteAddr)
+	pxy := hp.GetProxy(host, url, clientIP)
+	if pxy == nil {
+		log.Error("http proxy error:no router for ", host, url)
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("Not Found"))
+		return
+	}
+	if !pxy.(*HttpProxy).checkAccess(rw, req, clientIP) {
+		return
+	}
+
+	pm := pxy.GetMsg()
+	//basic认证的账号只用于访问代理，不转发给本地服务
+	if pm.HttpUser != "" || pm.HttpPwd != "" {
+		clientReq.Header.Del("Authorization")
+	}
+	host = pm.Host
 	log.Debug("real_host:", host)
 	if host != "" {
 		clientReq.Host = host
 	}
 	clientReq.URL.Host = host
+	if pm.HostHeaderRewrite != "" {
+		clientReq.Host = pm.HostHeaderRewrite
+	}
+	if pm.RewritePath != "" {
+		clientReq.URL.Path = rewritePath(clientReq.URL.Path, pm.Url, pm.RewritePath)
+		clientReq.URL.RawPath = ""
+	}
 
 	clientReq.Close = false
 
+	//Upgrade和Connection在删除逐跳头部前记录下来，转发时重新加上
+	reqUpType := upgradeType(clientReq.Header)
+
 	if con := clientReq.Header.Get("Connection"); con != "" {
 		for _, h := range strings.Split(con, ",") {
 			if h = strings.TrimSpace(h); h != "" {
@@ -97,18 +189,32 @@ func (hp *HttpReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 		}
 	}
 
-	//转发请求
-	transport := hp.Transport
-	if transport == nil {
-		transport = http.DefaultTransport
+	hp.setForwardedHeaders(clientReq, req)
+	rewriteHeader(clientReq.Header, pm.RemoveRequestHeaders, pm.RequestHeaders)
+	//请求中没有User-Agent时，阻止Transport添加默认值
+	if _, ok := clientReq.Header["User-Agent"]; !ok {
+		clientReq.Header.Set("User-Agent", "")
+	}
+
+	if reqUpType != "" {
+		clientReq.Header.Set("Connection", "Upgrade")
+		clientReq.Header.Set("Upgrade", reqUpType)
 	}
-	res, err := transport.RoundTrip(clientReq)
+
+	//转发请求
+	res, err := pxy.(*HttpProxy).transport.RoundTrip(clientReq)
 	if err != nil {
 		log.Error("http proxy error:", err)
 		rw.WriteHeader(http.StatusNotFound)
 		rw.Write([]byte("Not Found"))
 		return
 	}
+	rewriteHeader(res.Header, pm.RemoveResponseHeaders, pm.ResponseHeaders)
+
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		hp.handleUpgradeResponse(rw, clientReq, res, reqUpType)
+		return
+	}
 
 	if con := res.Header.Get("Connection"); con != "" {
 		for _, h := range strings.Split(con, ",") {
@@ -148,35 +254,142 @@ func (hp *HttpReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 	}
 }
 
-func (hp *HttpReverseProxy) GetRealHost(host, url string) (rhost string) {
+//101响应后接管用户连接，在用户连接和工作连接之间双向转发数据
+func (hp *HttpReverseProxy) handleUpgradeResponse(rw http.ResponseWriter, req *http.Request, res *http.Response, reqUpType string) {
+	resUpType := upgradeType(res.Header)
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		log.Error("http proxy error:upgrade response body is not writable")
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if reqUpType == "" || !strings.EqualFold(reqUpType, resUpType) {
+		backConn.Close()
+		log.Error("http proxy error:backend switched protocol to [", resUpType, "] but [", reqUpType, "] was requested")
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		backConn.Close()
+		log.Error("http proxy error:response writer does not support hijack")
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		backConn.Close()
+		log.Error("http proxy error:hijack failed:", err)
+		return
+	}
+
+	//写回101响应，用户连接上已缓冲的数据先发给工作连接
+	copyHeader(rw.Header(), res.Header)
+	res.Header = rw.Header()
+	res.Body = nil
+	if err = res.Write(brw); err == nil {
+		err = brw.Flush()
+	}
+	if err == nil && brw.Reader.Buffered() > 0 {
+		var buffered []byte
+		buffered, err = brw.Reader.Peek(brw.Reader.Buffered())
+		if err == nil {
+			_, err = backConn.Write(buffered)
+		}
+	}
+	if err != nil {
+		log.Error("http proxy error:upgrade response write failed:", err)
+		conn.Close()
+		backConn.Close()
+		return
+	}
+
+	log.Debug("switch protocol to ", resUpType, " for ", req.Host)
+	utils.BridgeConn(conn, backConn)
+}
+
+//向后端告知访问者的地址、原始协议和域名
+func (hp *HttpReverseProxy) setForwardedHeaders(clientReq, req *http.Request) {
+	h := clientReq.Header
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	hp.mu.RLock()
+	trustForwarded := hp.trustForwarded
+	hp.mu.RUnlock()
+	if !trustForwarded {
+		for _, k := range forwardedHeaders {
+			h.Del(k)
+		}
+	}
+
+	if prior := h.Get("X-Forwarded-For"); prior != "" {
+		h.Set("X-Forwarded-For", prior+", "+clientIP)
+	} else {
+		h.Set("X-Forwarded-For", clientIP)
+	}
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", req.Host)
+	}
+	if h.Get("X-Real-IP") == "" {
+		h.Set("X-Real-IP", clientIP)
+	}
+
+	//RFC 7239，IPv6地址需要加方括号和引号
+	node := clientIP
+	if strings.Contains(node, ":") {
+		node = "\"[" + node + "]\""
+	}
+	forwarded := fmt.Sprintf("for=%s;host=%q;proto=%s", node, req.Host, proto)
+	if prior := h.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	h.Set("Forwarded", forwarded)
+}
+
+//根据域名和url选择代理，同一分组的代理按负载均衡策略选择
+func (hp *HttpReverseProxy) GetProxy(host, url, clientIP string) Proxy {
 	r := hp.router.Get(host, url)
 	if r == nil {
-		return ""
+		return nil
 	}
-	return r.pxy.GetMsg().Host
+	return r.pick(clientIP)
 }
 
 func (hp *HttpReverseProxy) Register(domain, url string, pxy Proxy) error {
-	r := hp.router.Find(domain, url)
-	if r != nil {
-		err := fmt.Errorf("Register error:router is existed")
-		return err
-	} else {
-		hp.router.Add(domain, url, pxy)
+	if err := checkDomain(domain); err != nil {
+		return fmt.Errorf("Register error:%v", err)
+	}
+
+	r, err := hp.router.Add(domain, url, pxy)
+	if err != nil {
+		return fmt.Errorf("Register error:%v", err)
+	}
+	if r == nil {
 		log.Debug("add router  ", domain, ":", url)
 		return nil
 	}
-}
-func (hp *HttpReverseProxy) Remove(domain, url string) {
-	hp.router.Del(domain, url)
-}
 
-func (hp *HttpReverseProxy) GetConn(domain, url string) (net.Conn, error) {
-	r := hp.router.Get(domain, url)
-	if r == nil {
-		return nil, fmt.Errorf("conn not found")
+	for _, owner := range r.group.Members() {
+		if owner.GetClient().loginMsg.User == pxy.GetClient().loginMsg.User {
+			return fmt.Errorf("Register error:domain [%s] url [%s] is already used by proxy [%s]", domain, url, owner.GetName())
+		}
 	}
-	return r.pxy.GetWorkConn()
+	return fmt.Errorf("Register error:domain [%s] url [%s] is already used by another user", domain, url)
+}
+func (hp *HttpReverseProxy) Remove(domain, url string, pxy Proxy) {
+	hp.router.Del(domain, url, pxy)
 }
 
 var hopHeaders = []string{
@@ -191,6 +404,51 @@ var hopHeaders = []string{
 	"Upgrade",
 }
 
+var forwardedHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Real-IP",
+	"Forwarded",
+}
+
+func rewriteHeader(h http.Header, remove []string, set map[string]string) {
+	for _, k := range remove {
+		h.Del(k)
+	}
+	for k, v := range set {
+		h.Set(k, v)
+	}
+}
+
+//把path中的prefix前缀替换为target，prefix只在路径段的边界匹配，/api不改写/apiv2
+func rewritePath(path, prefix, target string) string {
+	if !strings.HasPrefix(path, prefix) {
+		return path
+	}
+	rest := strings.TrimPrefix(path, prefix)
+	if rest != "" && !strings.HasPrefix(rest, "/") && !strings.HasSuffix(prefix, "/") {
+		return path
+	}
+	if strings.HasSuffix(target, "/") && strings.HasPrefix(rest, "/") {
+		rest = rest[1:]
+	} else if !strings.HasSuffix(target, "/") && rest != "" && !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return target + rest
+}
+
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), "Upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
 func copyResponse(dst io.Writer, src io.Reader) {
 	buf := make([]byte, 32*1024)
 
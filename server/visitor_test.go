@@ -0,0 +1,414 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"proxy/config"
+	msg "proxy/message"
+)
+
+//GetWorkConn阻塞到收到ch中的连接
+type blockingProxy struct {
+	Proxy
+	ch chan net.Conn
+}
+
+func (p *blockingProxy) GetWorkConn() (net.Conn, error) {
+	return <-p.ch, nil
+}
+
+//请求取消后不再等待工作连接，之后到达的连接被关闭
+func TestGetWorkConnContextCancel(t *testing.T) {
+	pxy := &blockingProxy{ch: make(chan net.Conn)}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := getWorkConnContext(ctx, pxy); err != context.DeadlineExceeded {
+		t.Fatal("err =", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("cancelled request blocks for", d)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	pxy.ch <- c1
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("late work connection is not closed:", err)
+	}
+}
+
+func benchmarkHttpReverseProxy(b *testing.B, maxIdleConns int) {
+	httpPort := freePort(b)
+	svr := newTestService(b, func(conf *config.ServerConfig) {
+		conf.HttpProxy.VisitIP = "127.0.0.1"
+		conf.HttpProxy.VisitPort = httpPort
+		conf.HttpProxy.MaxIdleConns = maxIdleConns
+	})
+	newTestClient(b, svr, nil, &config.ProxyConf{
+		Name:      "web",
+		Type:      "http",
+		LocalIP:   "127.0.0.1",
+		LocalPort: newHttpServer(b, "hello"),
+		Domain:    "bench.test",
+	})
+	waitProxies(b, svr, 1)
+
+	hc := &http.Client{}
+	defer hc.CloseIdleConnections()
+	url := fmt.Sprintf("http://127.0.0.1:%d/", httpPort)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Host = "bench.test"
+		res, err := hc.Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			b.Fatal("status =", res.Status)
+		}
+	}
+}
+
+//对比复用工作连接(默认)和每个请求使用新工作连接的性能
+func BenchmarkHttpReverseProxy(b *testing.B) {
+	b.Run("default", func(b *testing.B) {
+		benchmarkHttpReverseProxy(b, 0)
+	})
+	b.Run("max_idle_conns=-1", func(b *testing.B) {
+		benchmarkHttpReverseProxy(b, -1)
+	})
+}
+
+//工作连接直接连接到addr的代理
+type dialProxy struct {
+	Proxy
+	addr string
+}
+
+func (p *dialProxy) GetWorkConn() (net.Conn, error) {
+	return net.Dial("tcp", p.addr)
+}
+
+//不经过客户端注册http代理，m.Domain的请求转发到backend
+func newTestHttpProxy(t *testing.T, hp *HttpReverseProxy, m msg.NewProxy, backend string) *HttpProxy {
+	m.ProxyName, m.ProxyType, m.Host = "web", "http", backend
+	pxy, err := NewProxy(&ClientCtrl{clientId: "test", loginMsg: &msg.Login{User: testUser}}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hpxy := pxy.(*HttpProxy)
+	hpxy.transport = hp.NewTransport(&dialProxy{Proxy: hpxy, addr: backend})
+	if err = hp.Register(hpxy.Domain, hpxy.Url, hpxy); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(hpxy.transport.CloseIdleConnections)
+	return hpxy
+}
+
+//接管连接并回复101的后端，先发送welcome，之后回显收到的数据；
+//请求中有proto参数时使用它作为切换后的协议
+func newUpgradeBackend(t *testing.T) string {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if upgradeType(req.Header) == "" {
+			http.Error(rw, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		proto := req.Header.Get("Upgrade")
+		if p := req.URL.Query().Get("proto"); p != "" {
+			proto = p
+		}
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + proto + "\r\n\r\nwelcome\n")
+		brw.Flush()
+		io.Copy(conn, brw.Reader)
+	}))
+	t.Cleanup(backend.Close)
+	return backend.Listener.Addr().String()
+}
+
+//发送升级请求，early为紧跟在请求头部之后发送的数据
+func sendUpgradeRequest(t *testing.T, addr, path, early string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: ws.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n%s", path, early)
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, res
+}
+
+//101响应返回给访问者，之后数据在访问者和后端之间双向转发
+func TestHttpReverseProxyUpgrade(t *testing.T) {
+	hp := NewHttpReverseProxy(&config.HttpProxyConf{})
+	newTestHttpProxy(t, hp, msg.NewProxy{Domain: "ws.test", Url: "/"}, newUpgradeBackend(t))
+	front := httptest.NewServer(hp)
+	defer front.Close()
+	addr := front.Listener.Addr().String()
+
+	conn, br, res := sendUpgradeRequest(t, addr, "/chat", "early\n")
+	if res.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(res.Header.Get("Upgrade"), "websocket") {
+		t.Fatalf("response = %s, upgrade %q", res.Status, res.Header.Get("Upgrade"))
+	}
+	//后端主动发送的数据，以及和请求头部一起到达的数据
+	for _, want := range []string{"welcome\n", "early\n"} {
+		if line, err := br.ReadString('\n'); err != nil || line != want {
+			t.Fatalf("read %q, %v, want %q", line, err, want)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		data := fmt.Sprintf("ping %d\n", i)
+		if _, err := conn.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if line, err := br.ReadString('\n'); err != nil || line != data {
+			t.Fatalf("read %q, %v, want %q", line, err, data)
+		}
+	}
+
+	//后端切换到其他协议时返回502
+	_, _, res = sendUpgradeRequest(t, addr, "/chat?proto=h2c", "")
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatal("mismatched upgrade response =", res.Status)
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	cases := []struct {
+		path, prefix, target string
+		want                 string
+	}{
+		{"/api", "/api", "/", "/"},
+		{"/api/", "/api", "/", "/"},
+		{"/api/users", "/api", "/", "/users"},
+		{"/api/users", "/api", "/v1", "/v1/users"},
+		{"/api/users", "/api", "/v1/", "/v1/users"},
+		{"/api", "/api", "/v1", "/v1"},
+		{"/api/users", "/api/", "/v1", "/v1/users"},
+		{"/api/users", "/api/", "/v1/", "/v1/users"},
+		{"/users", "/", "/app", "/app/users"},
+		{"/", "/", "/app/", "/app/"},
+		//不在路径段边界的前缀不改写
+		{"/apiv2", "/api", "/v1", "/apiv2"},
+		{"/apiv2/users", "/api", "/", "/apiv2/users"},
+		{"/api.json", "/api", "/v1", "/api.json"},
+		{"/other", "/api", "/v1", "/other"},
+	}
+	for _, c := range cases {
+		if got := rewritePath(c.path, c.prefix, c.target); got != c.want {
+			t.Errorf("rewritePath(%q, %q, %q) = %q, want %q", c.path, c.prefix, c.target, got, c.want)
+		}
+	}
+}
+
+func TestRewriteHeader(t *testing.T) {
+	cases := []struct {
+		name   string
+		remove []string
+		set    map[string]string
+		want   http.Header
+	}{
+		{"none", nil, nil, http.Header{"A": {"1"}, "B": {"2", "3"}}},
+		{"remove all values", []string{"b"}, nil, http.Header{"A": {"1"}}},
+		{"remove missing", []string{"C"}, nil, http.Header{"A": {"1"}, "B": {"2", "3"}}},
+		{"set new", nil, map[string]string{"x-new": "v"}, http.Header{"A": {"1"}, "B": {"2", "3"}, "X-New": {"v"}}},
+		{"set replaces", nil, map[string]string{"B": "4"}, http.Header{"A": {"1"}, "B": {"4"}}},
+		//先删除再设置
+		{"remove then set", []string{"A"}, map[string]string{"a": "5"}, http.Header{"A": {"5"}, "B": {"2", "3"}}},
+	}
+	for _, c := range cases {
+		h := http.Header{"A": {"1"}, "B": {"2", "3"}}
+		rewriteHeader(h, c.remove, c.set)
+		if fmt.Sprint(h) != fmt.Sprint(c.want) {
+			t.Errorf("%s: header = %v, want %v", c.name, h, c.want)
+		}
+	}
+}
+
+//请求和响应头部按配置改写，路径按rewrite_path改写
+func TestHttpReverseProxyRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Server", "backend")
+		rw.Header().Set("X-Powered-By", "test")
+		fmt.Fprintf(rw, "%s|%s|%s|%s", req.URL.Path, req.Header.Get("X-Env"), req.Header.Get("Cookie"), req.Header.Get("X-Keep"))
+	}))
+	defer backend.Close()
+
+	hp := NewHttpReverseProxy(&config.HttpProxyConf{})
+	newTestHttpProxy(t, hp, msg.NewProxy{
+		Domain:                "web.test",
+		Url:                   "/api",
+		RewritePath:           "/v1",
+		RequestHeaders:        map[string]string{"X-Env": "prod"},
+		RemoveRequestHeaders:  []string{"Cookie"},
+		ResponseHeaders:       map[string]string{"Server": "proxy"},
+		RemoveResponseHeaders: []string{"X-Powered-By"},
+	}, backend.Listener.Addr().String())
+	front := httptest.NewServer(hp)
+	defer front.Close()
+
+	for path, want := range map[string]string{
+		"/api/users": "/v1/users|prod||keep",
+		"/api":       "/v1|prod||keep",
+		"/apiv2":     "/apiv2|prod||keep",
+	} {
+		req, _ := http.NewRequest("GET", front.URL+path, nil)
+		req.Host = "web.test"
+		req.Header.Set("X-Env", "dev")
+		req.Header.Set("Cookie", "session=1")
+		req.Header.Set("X-Keep", "keep")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != want {
+			t.Errorf("%s: backend gets %q, want %q", path, body, want)
+		}
+		if res.Header.Get("Server") != "proxy" || res.Header.Get("X-Powered-By") != "" {
+			t.Errorf("%s: response header is not rewritten: %v", path, res.Header)
+		}
+	}
+}
+
+//配置了http_user和http_pwd时检查basic认证，认证头部不转发给本地服务
+func TestHttpReverseProxyBasicAuth(t *testing.T) {
+	var hits int64
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		fmt.Fprint(rw, req.Header.Get("Authorization"))
+	}))
+	defer backend.Close()
+
+	hp := NewHttpReverseProxy(&config.HttpProxyConf{})
+	pxy := newTestHttpProxy(t, hp, msg.NewProxy{Domain: "auth.test", Url: "/", HttpUser: "user", HttpPwd: "pwd"}, backend.Listener.Addr().String())
+	newTestHttpProxy(t, hp, msg.NewProxy{Domain: "open.test", Url: "/"}, backend.Listener.Addr().String())
+	front := httptest.NewServer(hp)
+	defer front.Close()
+
+	get := func(host string, auth func(req *http.Request)) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", front.URL, nil)
+		req.Host = host
+		if auth != nil {
+			auth(req)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(body)
+	}
+
+	res, _ := get("auth.test", nil)
+	if res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") == "" {
+		t.Fatal("request without credentials:", res.Status, res.Header)
+	}
+	res, _ = get("auth.test", func(req *http.Request) { req.SetBasicAuth("user", "wrong") })
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatal("request with wrong password:", res.Status)
+	}
+	if n := atomic.LoadInt64(&hits); n != 0 {
+		t.Fatal("rejected requests reach the local service:", n)
+	}
+
+	res, body := get("auth.test", func(req *http.Request) { req.SetBasicAuth("user", "pwd") })
+	if res.StatusCode != http.StatusOK || body != "" {
+		t.Fatalf("authorized request: %s, local service gets Authorization %q", res.Status, body)
+	}
+
+	//没有配置认证的代理原样转发
+	res, body = get("open.test", func(req *http.Request) { req.SetBasicAuth("app", "token") })
+	if res.StatusCode != http.StatusOK || body == "" {
+		t.Fatalf("open proxy: %s, local service gets Authorization %q", res.Status, body)
+	}
+
+	if s := pxy.GetHttpStats(); s != (HttpStats{Requests: 3, AuthRejected: 2}) {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+//deny_ips优先于allow_ips，被拒绝的请求回复403且不获取工作连接
+func TestHttpReverseProxyIpAccess(t *testing.T) {
+	var hits int64
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&hits, 1)
+	}))
+	defer backend.Close()
+
+	cases := []struct {
+		allow, deny []string
+		status      int
+	}{
+		{nil, nil, http.StatusOK},
+		{[]string{"127.0.0.1"}, nil, http.StatusOK},
+		{[]string{"10.0.0.0/8", "127.0.0.0/8"}, nil, http.StatusOK},
+		{[]string{"10.0.0.0/8"}, nil, http.StatusForbidden},
+		{nil, []string{"127.0.0.1"}, http.StatusForbidden},
+		{[]string{"127.0.0.0/8"}, []string{"127.0.0.1/32"}, http.StatusForbidden},
+		{nil, []string{"::1", "10.0.0.1"}, http.StatusOK},
+	}
+	hp := NewHttpReverseProxy(&config.HttpProxyConf{})
+	front := httptest.NewServer(hp)
+	defer front.Close()
+
+	for i, c := range cases {
+		host := fmt.Sprintf("ip%d.test", i)
+		pxy := newTestHttpProxy(t, hp, msg.NewProxy{Domain: host, Url: "/", AllowIPs: c.allow, DenyIPs: c.deny}, backend.Listener.Addr().String())
+
+		before := atomic.LoadInt64(&hits)
+		req, _ := http.NewRequest("GET", front.URL, nil)
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != c.status {
+			t.Errorf("allow %v deny %v: status = %d, want %d", c.allow, c.deny, res.StatusCode, c.status)
+		}
+
+		want := HttpStats{Requests: 1}
+		reached := int64(1)
+		if c.status == http.StatusForbidden {
+			want.IpRejected = 1
+			reached = 0
+		}
+		if s := pxy.GetHttpStats(); s != want {
+			t.Errorf("allow %v deny %v: stats = %+v, want %+v", c.allow, c.deny, s, want)
+		}
+		if n := atomic.LoadInt64(&hits) - before; n != reached {
+			t.Errorf("allow %v deny %v: local service gets %d requests", c.allow, c.deny, n)
+		}
+	}
+}
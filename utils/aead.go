@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//带认证的分帧加密，每个方向使用方向标签和握手时发送的随机salt派生独立的密钥
+//
+//帧格式: length(2) | ciphertext(length)
+//nonce为每帧递增的序号，length作为附加数据参与认证，帧被篡改、重放或乱序都会导致校验失败
+//关闭时发送一个明文为空的结束帧，没有收到结束帧就遇到EOF时视为数据被截断
+const (
+	EncryptMethodCfb = "cfb"
+	EncryptMethodGcm = "aes-gcm"
+
+	aeadSaltSize     = 32
+	aeadMaxFrameSize = 16 * 1024
+)
+
+var ErrAeadClosed = fmt.Errorf("encrypted writer is closed")
+
+//加密连接的一端，客户端到服务器和服务器到客户端使用不同的密钥，
+//一端发出的数据被反射回来时无法通过认证
+type EncryptRole int
+
+const (
+	RoleClient EncryptRole = iota
+	RoleServer
+)
+
+//本端发送数据使用的方向标签
+func (role EncryptRole) sendLabel() string {
+	if role == RoleClient {
+		return "client to server"
+	}
+	return "server to client"
+}
+
+//本端接收数据使用的方向标签
+func (role EncryptRole) recvLabel() string {
+	if role == RoleClient {
+		return "server to client"
+	}
+	return "client to server"
+}
+
+type FrameError struct {
+	Seq uint64
+	Err error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("encrypted frame %d is tampered or out of order: %v", e.Seq, e.Err)
+}
+
+func newGcm(key []byte, label string, salt []byte) (cipher.AEAD, error) {
+	master := sha256.Sum256(key)
+	mac := hmac.New(sha256.New, master[:])
+	mac.Write([]byte("proxy aead key|" + label + "|"))
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seqNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+type AeadWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	salt []byte
+	seq  uint64
+
+	saltSend bool
+	err      error
+	//Close可能和Write在不同的goroutine中调用
+	mu sync.Mutex
+}
+
+func NewAeadWriter(w io.Writer, key []byte, role EncryptRole) (*AeadWriter, error) {
+	salt := make([]byte, aeadSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGcm(key, role.sendLabel(), salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AeadWriter{
+		w:    w,
+		aead: aead,
+		salt: salt,
+	}, nil
+}
+
+func (w *AeadWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	buf := make([]byte, 0, aeadSaltSize+2+aeadMaxFrameSize+w.aead.Overhead())
+	for len(p) > 0 {
+		size := len(p)
+		if size > aeadMaxFrameSize {
+			size = aeadMaxFrameSize
+		}
+
+		if err = w.writeFrame(buf, p[:size]); err != nil {
+			return
+		}
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+//发送结束帧，之后不能再写入
+func (w *AeadWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return nil
+	}
+	err := w.writeFrame(make([]byte, 0, aeadSaltSize+2+w.aead.Overhead()), nil)
+	w.err = ErrAeadClosed
+	return err
+}
+
+func (w *AeadWriter) writeFrame(buf, plain []byte) error {
+	if !w.saltSend {
+		w.saltSend = true
+		buf = append(buf, w.salt...)
+	}
+
+	var hdr [2]byte
+	binary.BigEndian.PutUint16(hdr[:], uint16(len(plain)+w.aead.Overhead()))
+	buf = append(buf, hdr[:]...)
+	buf = w.aead.Seal(buf, seqNonce(w.aead, w.seq), plain, hdr[:])
+	w.seq++
+
+	if _, err := w.w.Write(buf); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+type AeadReader struct {
+	r     io.Reader
+	key   []byte
+	label string
+	aead  cipher.AEAD
+	seq   uint64
+
+	//已解密但还未被读取的数据
+	plain []byte
+	buf   []byte
+	err   error
+}
+
+func NewAeadReader(r io.Reader, key []byte, role EncryptRole) *AeadReader {
+	return &AeadReader{
+		r:     r,
+		key:   key,
+		label: role.recvLabel(),
+	}
+}
+
+func (r *AeadReader) Read(p []byte) (n int, err error) {
+	if len(r.plain) > 0 {
+		n = copy(p, r.plain)
+		r.plain = r.plain[n:]
+		return
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if r.aead == nil {
+		salt := make([]byte, aeadSaltSize)
+		if _, err = io.ReadFull(r.r, salt); err != nil {
+			r.err = truncated(err)
+			return 0, r.err
+		}
+		if r.aead, err = newGcm(r.key, r.label, salt); err != nil {
+			r.err = err
+			return
+		}
+		r.buf = make([]byte, aeadMaxFrameSize+r.aead.Overhead())
+	}
+
+	var hdr [2]byte
+	if _, err = io.ReadFull(r.r, hdr[:]); err != nil {
+		r.err = truncated(err)
+		return 0, r.err
+	}
+
+	size := int(binary.BigEndian.Uint16(hdr[:]))
+	if size < r.aead.Overhead() || size > len(r.buf) {
+		r.err = &FrameError{Seq: r.seq, Err: fmt.Errorf("invalid frame length %d", size)}
+		return 0, r.err
+	}
+	if _, err = io.ReadFull(r.r, r.buf[:size]); err != nil {
+		r.err = truncated(err)
+		return 0, r.err
+	}
+
+	plain, err := r.aead.Open(r.buf[:0], seqNonce(r.aead, r.seq), r.buf[:size], hdr[:])
+	if err != nil {
+		r.err = &FrameError{Seq: r.seq, Err: err}
+		return 0, r.err
+	}
+	r.seq++
+
+	//结束帧
+	if len(plain) == 0 {
+		r.err = io.EOF
+		return 0, r.err
+	}
+
+	n = copy(p, plain)
+	r.plain = plain[n:]
+	return
+}
+
+//在结束帧之前遇到EOF，说明数据流被截断
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
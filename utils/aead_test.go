@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+var aeadTestKey = []byte("123456")
+
+//把多次写入加密到缓冲区中，返回每一帧的起止位置，第一帧包含salt
+func sealFrames(t *testing.T, msgs ...string) ([]byte, [][2]int) {
+	var buf bytes.Buffer
+	w, err := NewAeadWriter(&buf, aeadTestKey, RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var frames [][2]int
+	for _, m := range msgs {
+		start := buf.Len()
+		if _, err := w.Write([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, [2]int{start, buf.Len()})
+	}
+	start := buf.Len()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	frames = append(frames, [2]int{start, buf.Len()})
+	return buf.Bytes(), frames
+}
+
+func TestAeadRoundTrip(t *testing.T) {
+	big := string(bytes.Repeat([]byte("x"), 3*aeadMaxFrameSize+7))
+	data, _ := sealFrames(t, "hello", big, "world")
+
+	plain, err := ioutil.ReadAll(NewAeadReader(bytes.NewReader(data), aeadTestKey, RoleServer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "hello"+big+"world" {
+		t.Fatal("plain text mismatch")
+	}
+}
+
+func TestAeadTamperedFrame(t *testing.T) {
+	data, frames := sealFrames(t, "hello", "world")
+	//翻转第二帧密文中的一位
+	data[frames[1][0]+5] ^= 0x01
+
+	r := NewAeadReader(bytes.NewReader(data), aeadTestKey, RoleServer)
+	buf := make([]byte, 16)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("first frame: %q, %v", buf[:n], err)
+	}
+	_, err := r.Read(buf)
+	if fe, ok := err.(*FrameError); !ok || fe.Seq != 1 {
+		t.Fatalf("read tampered frame = %v, want FrameError at seq 1", err)
+	}
+}
+
+func TestAeadReorderedFrames(t *testing.T) {
+	data, frames := sealFrames(t, "first", "second")
+	//交换第一帧和第二帧，salt保持在开头
+	f1 := data[frames[0][0]+aeadSaltSize : frames[0][1]]
+	f2 := data[frames[1][0]:frames[1][1]]
+	var swapped []byte
+	swapped = append(swapped, data[:aeadSaltSize]...)
+	swapped = append(swapped, f2...)
+	swapped = append(swapped, f1...)
+	swapped = append(swapped, data[frames[2][0]:]...)
+
+	_, err := NewAeadReader(bytes.NewReader(swapped), aeadTestKey, RoleServer).Read(make([]byte, 16))
+	if _, ok := err.(*FrameError); !ok {
+		t.Fatalf("read reordered frame = %v, want FrameError", err)
+	}
+}
+
+//在帧边界处截断时不能被当作正常结束
+func TestAeadTruncatedStream(t *testing.T) {
+	data, frames := sealFrames(t, "hello", "world")
+
+	r := NewAeadReader(bytes.NewReader(data[:frames[2][0]]), aeadTestKey, RoleServer)
+	plain, err := ioutil.ReadAll(r)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("read truncated stream = %v, want ErrUnexpectedEOF", err)
+	}
+	if string(plain) != "helloworld" {
+		t.Fatalf("plain text before truncation = %q", plain)
+	}
+}
+
+func newTcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ch := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		ch <- conn
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-ch
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return c1, c2
+}
+
+//收到被篡改的帧时，Read返回FrameError并关闭连接
+func TestEncryptionConnClosedOnTamper(t *testing.T) {
+	raw, peer := newTcpPair(t)
+	conn, err := Encryption(peer, aeadTestKey, EncryptMethodGcm, RoleServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, frames := sealFrames(t, "hello")
+	data[frames[0][1]-1] ^= 0x80
+	if _, err := raw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Fatal("read tampered frame succeeded")
+	} else if _, ok := err.(*FrameError); !ok {
+		t.Fatalf("read tampered frame = %v, want FrameError", err)
+	}
+
+	//连接已关闭，对方读到EOF或者连接被重置，而不是超时
+	raw.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := ioutil.ReadAll(raw); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("encrypted connection is not closed")
+		}
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Fatal("write after close succeeded")
+	}
+}
+
+func TestEncryptionConnCleanClose(t *testing.T) {
+	c1, c2 := newTcpPair(t)
+	w, err := Encryption(c1, aeadTestKey, EncryptMethodGcm, RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Encryption(c2, aeadTestKey, EncryptMethodGcm, RoleServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	r.SetReadDeadline(time.Now().Add(2 * time.Second))
+	plain, err := ioutil.ReadAll(r)
+	if err != nil || string(plain) != "hello" {
+		t.Fatalf("read %q, %v", plain, err)
+	}
+}
+
+//一端发出的数据被原样发回给它时不能通过认证
+func TestAeadReflectedFrames(t *testing.T) {
+	data, _ := sealFrames(t, "hello")
+
+	_, err := NewAeadReader(bytes.NewReader(data), aeadTestKey, RoleClient).Read(make([]byte, 16))
+	if _, ok := err.(*FrameError); !ok {
+		t.Fatalf("read reflected frame = %v, want FrameError", err)
+	}
+}
+
+func TestEncryptionConnReflection(t *testing.T) {
+	c1, raw := newTcpPair(t)
+	conn, err := Encryption(c1, aeadTestKey, EncryptMethodGcm, RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	//中间人把客户端发出的数据发回给客户端
+	buf := make([]byte, 1024)
+	raw.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := raw.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Write(buf[:n])
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Fatal("reflected data is accepted")
+	} else if _, ok := err.(*FrameError); !ok {
+		t.Fatalf("read reflected data = %v, want FrameError", err)
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Fatal("connection is not closed after reflected data")
+	}
+}
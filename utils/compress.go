@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	CompressNone   = "none"
+	CompressSnappy = "snappy"
+	CompressGzip   = "gzip"
+
+	snappyBlockSize = 64 * 1024
+)
+
+//压缩前后的字节数，Raw为压缩前的数据量
+type CompressStats struct {
+	OutRaw        int64 `json:"out_raw"`
+	OutCompressed int64 `json:"out_compressed"`
+	InRaw         int64 `json:"in_raw"`
+	InCompressed  int64 `json:"in_compressed"`
+}
+
+func (s *CompressStats) AddOut(raw, compressed int) {
+	atomic.AddInt64(&s.OutRaw, int64(raw))
+	atomic.AddInt64(&s.OutCompressed, int64(compressed))
+}
+
+func (s *CompressStats) AddIn(raw, compressed int) {
+	atomic.AddInt64(&s.InRaw, int64(raw))
+	atomic.AddInt64(&s.InCompressed, int64(compressed))
+}
+
+func (s *CompressStats) Snapshot() CompressStats {
+	return CompressStats{
+		OutRaw:        atomic.LoadInt64(&s.OutRaw),
+		OutCompressed: atomic.LoadInt64(&s.OutCompressed),
+		InRaw:         atomic.LoadInt64(&s.InRaw),
+		InCompressed:  atomic.LoadInt64(&s.InCompressed),
+	}
+}
+
+func IsValidCompression(method string) bool {
+	switch method {
+	case "", CompressNone, CompressSnappy, CompressGzip:
+		return true
+	}
+	return false
+}
+
+//在加密之上再包装一层压缩，写入时先压缩再交给加密层
+func Compression(c net.Conn, method string, stats *CompressStats) (net.Conn, error) {
+	if stats == nil {
+		stats = &CompressStats{}
+	}
+
+	counter := &countConn{
+		Conn:  c,
+		stats: stats,
+	}
+
+	switch method {
+	case "", CompressNone:
+		return c, nil
+	case CompressSnappy:
+		return &snappyConn{
+			Conn:    c,
+			counter: counter,
+		}, nil
+	case CompressGzip:
+		return &gzipConn{
+			Conn:    c,
+			counter: counter,
+			gw:      gzip.NewWriter(counter),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %s", method)
+}
+
+//统计压缩后实际读写的字节数
+type countConn struct {
+	net.Conn
+	stats *CompressStats
+}
+
+func (c *countConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.stats.AddIn(0, n)
+	return
+}
+
+func (c *countConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	c.stats.AddOut(0, n)
+	return
+}
+
+//每个块的格式: flag(1) | length(4) | data，flag为0表示原始数据，为1表示snappy压缩的数据
+type snappyConn struct {
+	net.Conn
+	counter *countConn
+
+	plain  []byte
+	rbuf   []byte
+	wbuf   []byte
+	header [5]byte
+}
+
+func (c *snappyConn) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		size := len(p)
+		if size > snappyBlockSize {
+			size = snappyBlockSize
+		}
+		block := p[:size]
+
+		c.wbuf = snappy.Encode(c.wbuf[:cap(c.wbuf)], block)
+		flag := byte(1)
+		data := c.wbuf
+		if len(data) >= len(block) {
+			flag = 0
+			data = block
+		}
+
+		frame := make([]byte, 5, 5+len(data))
+		frame[0] = flag
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+		if _, err = c.counter.Write(append(frame, data...)); err != nil {
+			return
+		}
+		c.counter.stats.AddOut(size, 0)
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+func (c *snappyConn) Read(p []byte) (n int, err error) {
+	if len(c.plain) == 0 {
+		if _, err = io.ReadFull(c.counter, c.header[:]); err != nil {
+			return
+		}
+		size := int(binary.BigEndian.Uint32(c.header[1:]))
+		if size > snappy.MaxEncodedLen(snappyBlockSize) {
+			return 0, snappy.ErrCorrupt
+		}
+		if cap(c.rbuf) < size {
+			c.rbuf = make([]byte, size)
+		}
+		data := c.rbuf[:size]
+		if _, err = io.ReadFull(c.counter, data); err != nil {
+			return
+		}
+
+		switch c.header[0] {
+		case 0:
+			if size > snappyBlockSize {
+				return 0, snappy.ErrCorrupt
+			}
+			c.plain = data
+		case 1:
+			//解压后的长度来自对方，分配内存前先检查
+			dLen, err := snappy.DecodedLen(data)
+			if err != nil || dLen > snappyBlockSize {
+				return 0, snappy.ErrCorrupt
+			}
+			if c.plain, err = snappy.Decode(nil, data); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, snappy.ErrCorrupt
+		}
+		c.counter.stats.AddIn(len(c.plain), 0)
+	}
+
+	n = copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return
+}
+
+type gzipConn struct {
+	net.Conn
+	counter *countConn
+
+	gw *gzip.Writer
+	gr *gzip.Reader
+
+	//Close时写入gzip结尾，可能和Write在不同的goroutine中调用
+	closed bool
+	mu     sync.Mutex
+}
+
+func (c *gzipConn) Write(p []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if n, err = c.gw.Write(p); err != nil {
+		return
+	}
+	//交互式的流量需要立即发送
+	err = c.gw.Flush()
+	c.counter.stats.AddOut(n, 0)
+	return
+}
+
+func (c *gzipConn) Read(p []byte) (n int, err error) {
+	//gzip.NewReader会阻塞读取头部，所以在第一次读取时再创建
+	if c.gr == nil {
+		if c.gr, err = gzip.NewReader(c.counter); err != nil {
+			return
+		}
+		c.gr.Multistream(false)
+	}
+
+	n, err = c.gr.Read(p)
+	c.counter.stats.AddIn(n, 0)
+	return
+}
+
+func (c *gzipConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.Conn.SetWriteDeadline(time.Now().Add(CloseWriteTimeout))
+		c.gw.Close()
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func snappyTestInputs() [][]byte {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	r.Read(random)
+
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 2000)
+
+	mixed := make([]byte, 0, 200000)
+	for i := 0; i < 1000; i++ {
+		if i%3 == 0 {
+			mixed = append(mixed, random[i*50:i*50+50]...)
+		} else {
+			mixed = append(mixed, text[:i%120+1]...)
+		}
+	}
+
+	return [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("abcd"),
+		bytes.Repeat([]byte{0}, 70000),
+		random,
+		text,
+		mixed,
+	}
+}
+
+//压缩块损坏时返回错误而不是panic
+func TestSnappyConnCorruptBlock(t *testing.T) {
+	encoded := snappy.Encode(nil, snappyTestInputs()[6][:snappyBlockSize])
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 200; i++ {
+		data := append([]byte{}, encoded[:r.Intn(len(encoded))]...)
+		for j := 0; j < 3 && len(data) > 0; j++ {
+			data[r.Intn(len(data))] = byte(r.Intn(256))
+		}
+
+		c1, c2 := net.Pipe()
+		conn, _ := Compression(c2, CompressSnappy, nil)
+		frame := []byte{1, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+		go func() {
+			c1.Write(append(frame, data...))
+			c1.Close()
+		}()
+		ioutil.ReadAll(conn)
+		conn.Close()
+	}
+}
+
+//对方声明的解压长度过大时，在分配内存之前拒绝
+func TestSnappyConnRejectsOversizedBlock(t *testing.T) {
+	c1, c2 := newTcpPair(t)
+	conn, err := Compression(c2, CompressSnappy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := binary.AppendUvarint(nil, 0xffffffff)
+	data = append(data, 0)
+	frame := []byte{1, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	c1.Write(append(frame, data...))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = conn.Read(make([]byte, 16))
+	runtime.ReadMemStats(&after)
+
+	if err != snappy.ErrCorrupt {
+		t.Fatalf("read oversized block = %v, want snappy.ErrCorrupt", err)
+	}
+	if after.TotalAlloc-before.TotalAlloc > 1<<20 {
+		t.Fatalf("allocated %d bytes for a rejected block", after.TotalAlloc-before.TotalAlloc)
+	}
+}
+
+func testCompressConn(t *testing.T, method string) {
+	c1, c2 := newTcpPair(t)
+	var stats CompressStats
+	w, err := Compression(c1, method, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Compression(c2, method, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []byte
+	go func() {
+		for _, src := range snappyTestInputs() {
+			w.Write(src)
+		}
+		w.Close()
+	}()
+	for _, src := range snappyTestInputs() {
+		want = append(want, src...)
+	}
+
+	//正常关闭时对方读到EOF，而不是ErrUnexpectedEOF
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: data mismatch", method)
+	}
+
+	s := stats.Snapshot()
+	if s.OutRaw != int64(len(want)) || s.OutCompressed == 0 || s.OutCompressed >= s.OutRaw {
+		t.Fatalf("%s: unexpected stats %+v", method, s)
+	}
+}
+
+func TestSnappyConn(t *testing.T) {
+	testCompressConn(t, CompressSnappy)
+}
+
+func TestGzipConnCleanClose(t *testing.T) {
+	testCompressConn(t, CompressGzip)
+}
+
+func TestGzipConnWriteAfterClose(t *testing.T) {
+	c1, _ := newTcpPair(t)
+	w, err := Compression(c1, CompressGzip, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err := w.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Fatalf("write after close = %v, want ErrClosedPipe", err)
+	}
+}
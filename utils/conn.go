@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+//在两个连接之间双向转发数据，任意一个方向结束后关闭两个连接
+func BridgeConn(conn1, conn2 io.ReadWriteCloser) {
+	var wait sync.WaitGroup
+	wait.Add(2)
+
+	Copy := func(dst, src io.ReadWriteCloser) {
+		defer wait.Done()
+		defer dst.Close()
+		defer src.Close()
+
+		buf := make([]byte, 16*1024)
+		io.CopyBuffer(dst, src, buf)
+	}
+
+	go Copy(conn2, conn1)
+	go Copy(conn1, conn2)
+	wait.Wait()
+}
+
+//代理的流量统计，In为从服务器收到的字节数，Out为发往服务器的字节数
+type TrafficStats struct {
+	TrafficIn  int64 `json:"traffic_in"`
+	TrafficOut int64 `json:"traffic_out"`
+	CurConns   int64 `json:"cur_conns"`
+	TotalConns int64 `json:"total_conns"`
+}
+
+func (s *TrafficStats) Snapshot() TrafficStats {
+	return TrafficStats{
+		TrafficIn:  atomic.LoadInt64(&s.TrafficIn),
+		TrafficOut: atomic.LoadInt64(&s.TrafficOut),
+		CurConns:   atomic.LoadInt64(&s.CurConns),
+		TotalConns: atomic.LoadInt64(&s.TotalConns),
+	}
+}
+
+type statsConn struct {
+	net.Conn
+	stats *TrafficStats
+	once  sync.Once
+}
+
+//包装连接，统计读写的字节数和当前连接数
+func NewStatsConn(c net.Conn, stats *TrafficStats) net.Conn {
+	atomic.AddInt64(&stats.CurConns, 1)
+	atomic.AddInt64(&stats.TotalConns, 1)
+	return &statsConn{
+		Conn:  c,
+		stats: stats,
+	}
+}
+
+func (c *statsConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	atomic.AddInt64(&c.stats.TrafficIn, int64(n))
+	return
+}
+
+func (c *statsConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	atomic.AddInt64(&c.stats.TrafficOut, int64(n))
+	return
+}
+
+func (c *statsConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.stats.CurConns, -1)
+	})
+	return c.Conn.Close()
+}
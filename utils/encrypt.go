@@ -3,17 +3,26 @@ package utils
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
 )
 
 const (
 	IdLen = 8
+
+	//关闭连接前发送结束数据的超时时间
+	CloseWriteTimeout = time.Second
 )
 
 type ReadWriteCloser struct {
@@ -25,13 +34,26 @@ type ReadWriteCloser struct {
 	mu      sync.Mutex
 }
 
-func Encryption(c net.Conn, key []byte) (*ReadWriteCloser, error) {
-	w, err := NewWriter(c, key)
+//method为空时使用旧的AES-CFB，不提供完整性校验；role为本端是客户端还是服务器
+func Encryption(c net.Conn, key []byte, method string, role EncryptRole) (*ReadWriteCloser, error) {
+	var r io.Reader
+	var w io.Writer
+	var err error
+
+	switch method {
+	case EncryptMethodCfb, "":
+		w, err = NewWriter(c, key)
+		r = NewReader(c, key)
+	case EncryptMethodGcm:
+		w, err = NewAeadWriter(c, key, role)
+		r = NewAeadReader(c, key, role)
+	default:
+		err = fmt.Errorf("unsupported encryption method: %s", method)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	r := NewReader(c, key)
 	encrypt_conn := &ReadWriteCloser{
 		r: r,
 		w: w,
@@ -45,7 +67,13 @@ func Encryption(c net.Conn, key []byte) (*ReadWriteCloser, error) {
 }
 
 func (rw *ReadWriteCloser) Read(p []byte) (n int, err error) {
-	return rw.r.Read(p)
+	n, err = rw.r.Read(p)
+	if _, ok := err.(*FrameError); ok {
+		//数据被篡改时直接断开连接
+		log.Warn("close encrypted connection from ", rw.RemoteAddr(), ":", err)
+		rw.Close()
+	}
+	return
 }
 
 func (rw *ReadWriteCloser) Write(p []byte) (n int, err error) {
@@ -61,6 +89,10 @@ func (rw *ReadWriteCloser) Close() (err error) {
 	}
 
 	rw.closed = true
+	//对方不再读取时，发送结束帧不能一直阻塞
+	if rw.Conn != nil {
+		rw.Conn.SetWriteDeadline(time.Now().Add(CloseWriteTimeout))
+	}
 	if rc, ok := rw.r.(io.Closer); ok {
 		err = rc.Close()
 	}
@@ -150,7 +182,7 @@ func NewReader(r io.Reader, key []byte) *Reader {
 
 func (r *Reader) Read(p []byte) (n int, err error) {
 	if r.err != nil {
-		return 0, err
+		return 0, r.err
 	}
 
 	if r.decrypt == nil {
@@ -186,6 +218,133 @@ func GetMD5(data []byte) ([]byte, string) {
 
 }
 
+func GetHmacSign(key []byte, data string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//常数时间比较两个签名
+func SignEqual(a, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
+
+func GetNonce() (nonce string, err error) {
+	data := make([]byte, 16)
+	if _, err = rand.Read(data); err != nil {
+		return
+	}
+	nonce = hex.EncodeToString(data)
+	return
+}
+
+const (
+	TokenHashMethod = "scram-sha256"
+	tokenHashIter   = 10000
+)
+
+//生成随机的用户token
+func GenerateToken() (token string, err error) {
+	data := make([]byte, 32)
+	if _, err = rand.Read(data); err != nil {
+		return
+	}
+	token = hex.EncodeToString(data)
+	return
+}
+
+//计算token的校验值，格式为 scram-sha256$salt$storedKey，服务器只保存校验值。
+//storedKey = SHA256(HMAC(DeriveTokenKey(token, salt), "client key"))，
+//可以验证客户端的登录证明，但是不能用来计算证明，文件泄露后不能冒充客户端登录
+func HashToken(token string) (hash string, err error) {
+	salt, err := GetNonce()
+	if err != nil {
+		return
+	}
+	storedKey := StoredTokenKey(ClientTokenKey(DeriveTokenKey(token, salt)))
+	hash = fmt.Sprintf("%s$%s$%s", TokenHashMethod, salt, hex.EncodeToString(storedKey))
+	return
+}
+
+//解析token的校验值，返回hex编码的storedKey，不是校验值格式时ok为false
+func ParseTokenHash(hash string) (salt, storedKey string, ok bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 || parts[0] != TokenHashMethod || parts[1] == "" || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+//由token和salt计算客户端的密钥，客户端和服务器必须保持一致
+func DeriveTokenKey(token, salt string) string {
+	return hex.EncodeToString(pbkdf2Sha256([]byte(token), []byte(salt), tokenHashIter))
+}
+
+func ClientTokenKey(derivedKey string) []byte {
+	mac := hmac.New(sha256.New, []byte(derivedKey))
+	mac.Write([]byte("client key"))
+	return mac.Sum(nil)
+}
+
+func StoredTokenKey(clientKey []byte) []byte {
+	sum := sha256.Sum256(clientKey)
+	return sum[:]
+}
+
+//客户端的登录证明 clientKey XOR HMAC(storedKey, signData)
+func TokenProof(clientKey, storedKey []byte, signData string) string {
+	mac := hmac.New(sha256.New, storedKey)
+	mac.Write([]byte(signData))
+	proof := mac.Sum(nil)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return hex.EncodeToString(proof)
+}
+
+//服务器由登录证明还原clientKey，并检查它的哈希值是否等于storedKey
+func VerifyTokenProof(storedKey []byte, signData, proof string) (clientKey []byte, ok bool) {
+	data, err := hex.DecodeString(proof)
+	if err != nil || len(data) != sha256.Size {
+		return nil, false
+	}
+	mac := hmac.New(sha256.New, storedKey)
+	mac.Write([]byte(signData))
+	clientKey = mac.Sum(nil)
+	for i := range clientKey {
+		clientKey[i] ^= data[i]
+	}
+	if !hmac.Equal(StoredTokenKey(clientKey), storedKey) {
+		return nil, false
+	}
+	return clientKey, true
+}
+
+//本次连接的加密密钥，只有持有token的客户端和验证过登录证明的服务器可以计算
+func SessionTokenKey(clientKey []byte, nonce string) string {
+	return GetHmacSign(clientKey, "session key|"+nonce)
+}
+
+//只输出一个块的PBKDF2，即32字节
+func pbkdf2Sha256(password, salt []byte, iter int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iter; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
 func GetClientId() (id string, err error) {
 	data := make([]byte, IdLen)
 	_, err = rand.Read(data)
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestTokenProof(t *testing.T) {
+	hash, err := HashToken("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, stored, ok := ParseTokenHash(hash)
+	if !ok {
+		t.Fatal("parse hash failed:", hash)
+	}
+	storedKey, _ := hex.DecodeString(stored)
+
+	clientKey := ClientTokenKey(DeriveTokenKey("secret", salt))
+	proof := TokenProof(clientKey, storedKey, "nonce|test")
+	key, ok := VerifyTokenProof(storedKey, "nonce|test", proof)
+	if !ok || hex.EncodeToString(key) != hex.EncodeToString(clientKey) {
+		t.Fatal("valid proof is rejected")
+	}
+	if _, ok := VerifyTokenProof(storedKey, "nonce2|test", proof); ok {
+		t.Fatal("proof for other sign data is accepted")
+	}
+
+	wrongKey := ClientTokenKey(DeriveTokenKey("wrong", salt))
+	if _, ok := VerifyTokenProof(storedKey, "nonce|test", TokenProof(wrongKey, storedKey, "nonce|test")); ok {
+		t.Fatal("proof with wrong token is accepted")
+	}
+}
+
+//只持有文件中的校验值时不能计算出有效的登录证明
+func TestStoredKeyCanNotSign(t *testing.T) {
+	hash, _ := HashToken("secret")
+	salt, stored, _ := ParseTokenHash(hash)
+	storedKey, _ := hex.DecodeString(stored)
+
+	for _, key := range [][]byte{storedKey, []byte(stored), ClientTokenKey(stored), ClientTokenKey(salt)} {
+		if _, ok := VerifyTokenProof(storedKey, "nonce|test", TokenProof(key, storedKey, "nonce|test")); ok {
+			t.Fatal("proof computed from the stored key is accepted")
+		}
+	}
+}
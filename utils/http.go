@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+//用固定时间比较用户名和密码，避免通过响应时间猜测
+func SecureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+//管理接口的json响应
+func WriteJson(rw http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		WriteError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(data)
+}
+
+//错误响应的格式为{"error": message}
+func WriteError(rw http.ResponseWriter, code int, message string) {
+	data, _ := json.Marshal(map[string]string{"error": message})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(data)
+}
@@ -0,0 +1,534 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//多路复用：在一条tcp连接上传输多个逻辑流，每个流有独立的流量控制窗口
+//
+//帧格式: version(1) | type(1) | streamId(4) | length(4) | data
+//window update帧的length表示增加的窗口大小，不携带数据
+const (
+	MuxVersion byte = 'M'
+
+	muxHeaderSize   = 10
+	muxMaxFrameSize = 32 * 1024
+	muxWindowSize   = 256 * 1024
+	muxAcceptLen    = 64
+
+	frameSyn          byte = 0
+	frameData         byte = 1
+	frameWindowUpdate byte = 2
+	frameFin          byte = 3
+	frameRst          byte = 4
+)
+
+var (
+	ErrSessionClosed = fmt.Errorf("mux session is closed")
+	ErrStreamClosed  = fmt.Errorf("mux stream is closed")
+	ErrStreamReset   = fmt.Errorf("mux stream is reset by peer")
+	ErrTimeout       = &timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "mux i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+type Session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	//客户端使用奇数id，服务端使用偶数id
+	nextId  uint32
+	streams map[uint32]*Stream
+
+	acceptCh chan *Stream
+	closeCh  chan struct{}
+	closed   bool
+	err      error
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+}
+
+//client为true时，表示由客户端一侧创建
+func NewSession(conn net.Conn, client bool) *Session {
+	s := &Session{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		streams:  make(map[uint32]*Stream),
+		acceptCh: make(chan *Stream, muxAcceptLen),
+		closeCh:  make(chan struct{}),
+	}
+	if client {
+		s.nextId = 1
+	} else {
+		s.nextId = 2
+	}
+
+	go s.recvLoop()
+	return s
+}
+
+//预读连接上的第一个字节，用于区分多路复用、tls和普通连接，返回的连接会保留已经预读的数据
+func PeekByte(conn net.Conn) (byte, net.Conn, error) {
+	r := bufio.NewReader(conn)
+	b, err := r.Peek(1)
+	if err != nil {
+		return 0, conn, err
+	}
+
+	c := &bufferedConn{
+		Conn: conn,
+		r:    r,
+	}
+	return b[0], c, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextId
+	s.nextId += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameSyn, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.closeCh:
+		return nil, ErrSessionClosed
+	}
+}
+
+func (s *Session) Close() error {
+	s.closeWithErr(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) IsClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) closeWithErr(err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	close(s.closeCh)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, stream := range streams {
+		stream.reset(err)
+	}
+}
+
+func (s *Session) writeFrame(frameType byte, id uint32, data []byte) error {
+	return s.writeFrameLen(frameType, id, uint32(len(data)), data)
+}
+
+func (s *Session) writeFrameLen(frameType byte, id uint32, length uint32, data []byte) error {
+	hdr := make([]byte, muxHeaderSize, muxHeaderSize+len(data))
+	hdr[0] = MuxVersion
+	hdr[1] = frameType
+	binary.BigEndian.PutUint32(hdr[2:6], id)
+	binary.BigEndian.PutUint32(hdr[6:10], length)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	if _, err := s.conn.Write(append(hdr, data...)); err != nil {
+		s.closeWithErr(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) recvLoop() {
+	hdr := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.reader, hdr); err != nil {
+			s.closeWithErr(err)
+			return
+		}
+		if hdr[0] != MuxVersion {
+			s.closeWithErr(fmt.Errorf("invalid mux version: %d", hdr[0]))
+			return
+		}
+
+		frameType := hdr[1]
+		id := binary.BigEndian.Uint32(hdr[2:6])
+		length := binary.BigEndian.Uint32(hdr[6:10])
+
+		switch frameType {
+		case frameSyn:
+			s.handleSyn(id)
+
+		case frameData:
+			if length > muxMaxFrameSize {
+				s.closeWithErr(fmt.Errorf("mux frame too large: %d", length))
+				return
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(s.reader, data); err != nil {
+				s.closeWithErr(err)
+				return
+			}
+			if stream := s.getStream(id); stream != nil {
+				if err := stream.pushData(data); err != nil {
+					s.closeWithErr(err)
+					return
+				}
+			}
+
+		case frameWindowUpdate:
+			if stream := s.getStream(id); stream != nil {
+				stream.incrSendWindow(length)
+			}
+
+		case frameFin:
+			if stream := s.getStream(id); stream != nil {
+				stream.remoteFin()
+			}
+
+		case frameRst:
+			if stream := s.getStream(id); stream != nil {
+				s.removeStream(id)
+				stream.reset(ErrStreamReset)
+			}
+
+		default:
+			s.closeWithErr(fmt.Errorf("invalid mux frame type: %d", frameType))
+			return
+		}
+	}
+}
+
+func (s *Session) handleSyn(id uint32) {
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	select {
+	case s.acceptCh <- stream:
+	default:
+		//等待Accept的流过多，直接拒绝
+		s.removeStream(id)
+		go s.writeFrame(frameRst, id, nil)
+	}
+}
+
+//多路复用中的一个逻辑流，实现了net.Conn
+type Stream struct {
+	id      uint32
+	session *Session
+
+	recvBuf bytes.Buffer
+	//已读取但还未通知对方的窗口大小
+	recvConsumed uint32
+	sendWindow   uint32
+
+	localClosed  bool
+	remoteClosed bool
+	err          error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	//数据、窗口或状态变化时通知
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+	mu          sync.Mutex
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:          id,
+		session:     s,
+		sendWindow:  muxWindowSize,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) Session() *Session {
+	return st.session
+}
+
+func (st *Stream) pushData(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.recvBuf.Len()+len(data) > muxWindowSize {
+		return fmt.Errorf("mux stream %d receive window exceeded", st.id)
+	}
+	if !st.localClosed {
+		st.recvBuf.Write(data)
+	}
+	notify(st.readNotify)
+	return nil
+}
+
+func (st *Stream) incrSendWindow(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	notify(st.writeNotify)
+}
+
+func (st *Stream) remoteFin() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.mu.Unlock()
+
+	notify(st.readNotify)
+	if done {
+		st.session.removeStream(st.id)
+	}
+}
+
+func (st *Stream) reset(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+
+	notify(st.readNotify)
+	notify(st.writeNotify)
+}
+
+func waitNotify(ch chan struct{}, deadline time.Time, closeCh chan struct{}) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return ErrTimeout
+	case <-closeCh:
+		return ErrSessionClosed
+	}
+}
+
+func (st *Stream) Read(p []byte) (n int, err error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ = st.recvBuf.Read(p)
+			st.recvConsumed += uint32(n)
+			var delta uint32
+			if st.recvConsumed >= muxWindowSize/2 && !st.remoteClosed {
+				delta = st.recvConsumed
+				st.recvConsumed = 0
+			}
+			st.mu.Unlock()
+
+			if delta > 0 {
+				st.session.writeFrameLen(frameWindowUpdate, st.id, delta, nil)
+			}
+			return n, nil
+		}
+
+		switch {
+		case st.localClosed:
+			err = ErrStreamClosed
+		case st.remoteClosed:
+			err = io.EOF
+		case st.err != nil:
+			err = st.err
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		if err = waitNotify(st.readNotify, deadline, st.session.closeCh); err == ErrSessionClosed {
+			//会话关闭前收到的数据仍然可以读取
+			st.reset(ErrSessionClosed)
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.localClosed:
+			err = ErrStreamClosed
+		case st.err != nil:
+			err = st.err
+		}
+		window := st.sendWindow
+		deadline := st.writeDeadline
+		st.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+
+		if window == 0 {
+			if err = waitNotify(st.writeNotify, deadline, st.session.closeCh); err != nil {
+				return
+			}
+			continue
+		}
+
+		size := len(p)
+		if size > int(window) {
+			size = int(window)
+		}
+		if size > muxMaxFrameSize {
+			size = muxMaxFrameSize
+		}
+
+		st.mu.Lock()
+		st.sendWindow -= uint32(size)
+		st.mu.Unlock()
+
+		if err = st.session.writeFrame(frameData, st.id, p[:size]); err != nil {
+			return
+		}
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.recvBuf.Reset()
+	reset := st.err != nil
+	done := st.remoteClosed || reset
+	st.mu.Unlock()
+
+	notify(st.readNotify)
+	notify(st.writeNotify)
+	if done {
+		st.session.removeStream(st.id)
+	}
+	if !reset {
+		return st.session.writeFrame(frameFin, st.id, nil)
+	}
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readNotify)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeNotify)
+	return nil
+}
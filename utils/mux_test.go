@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//在本地tcp连接上建立一对会话
+func newSessionPair(t *testing.T) (client, server *Session) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ch := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		ch <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = NewSession(conn, true)
+	server = NewSession(<-ch, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+func openPair(t *testing.T, client, server *Session) (*Stream, *Stream) {
+	cs, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs, ss
+}
+
+func waitStreams(t *testing.T, s *Session, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for s.NumStreams() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("session has %d streams, want %d", s.NumStreams(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMuxRoundTrip(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	//服务端回显每个流上的数据
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+
+			data := make([]byte, 3*muxWindowSize+123)
+			rand.Read(data)
+			go st.Write(data)
+
+			buf := make([]byte, len(data))
+			st.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(st, buf); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(buf, data) {
+				t.Error("echo data mismatch")
+			}
+		}()
+	}
+	wait.Wait()
+}
+
+//接收方不读取时，发送方最多写入一个窗口的数据
+func TestMuxWindowBackPressure(t *testing.T) {
+	client, server := newSessionPair(t)
+	cs, ss := openPair(t, client, server)
+
+	data := make([]byte, 2*muxWindowSize)
+	rand.Read(data)
+
+	cs.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := cs.Write(data)
+	if err != ErrTimeout {
+		t.Fatalf("write error = %v, want timeout", err)
+	}
+	if n != muxWindowSize {
+		t.Fatalf("wrote %d bytes before blocking, want %d", n, muxWindowSize)
+	}
+
+	//接收方读取后窗口恢复，剩余数据可以继续写入
+	done := make(chan error, 1)
+	go func() {
+		cs.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err := cs.Write(data[n:])
+		done <- err
+	}()
+
+	buf := make([]byte, len(data))
+	ss.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(ss, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data mismatch after window update")
+	}
+}
+
+func TestMuxFinRemovesStream(t *testing.T) {
+	client, server := newSessionPair(t)
+	cs, ss := openPair(t, client, server)
+
+	if _, err := cs.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	cs.Close()
+
+	//关闭前发送的数据仍然可以读取，之后返回EOF
+	buf := make([]byte, 3)
+	ss.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(ss, buf); err != nil || string(buf) != "bye" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	if _, err := ss.Read(buf); err != io.EOF {
+		t.Fatalf("read after fin = %v, want EOF", err)
+	}
+
+	ss.Close()
+	waitStreams(t, client, 0)
+	waitStreams(t, server, 0)
+
+	if _, err := cs.Write([]byte("x")); err != ErrStreamClosed {
+		t.Fatalf("write after close = %v, want ErrStreamClosed", err)
+	}
+}
+
+//等待Accept的流过多时，新的流被对方重置
+func TestMuxRstRemovesStream(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	streams := make([]*Stream, 0, muxAcceptLen+1)
+	for i := 0; i < muxAcceptLen+1; i++ {
+		st, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, st)
+	}
+
+	last := streams[muxAcceptLen]
+	last.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := last.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Fatalf("read on rejected stream = %v, want ErrStreamReset", err)
+	}
+	waitStreams(t, client, muxAcceptLen)
+	waitStreams(t, server, muxAcceptLen)
+
+	if _, err := last.Write([]byte("x")); err != ErrStreamReset {
+		t.Fatalf("write on reset stream = %v, want ErrStreamReset", err)
+	}
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//生成发送给本地服务的PROXY protocol头部，src为访问者地址，dst为服务器上被访问的地址
+//地址无法解析时，v1使用UNKNOWN，v2使用LOCAL命令，本地服务按直连处理
+func ProxyProtocolHeader(version, src, dst string) ([]byte, error) {
+	srcAddr := resolveProxyAddr(src)
+	dstAddr := resolveProxyAddr(dst)
+	if srcAddr != nil && dstAddr != nil {
+		//两端地址族不同时统一转换为IPv6
+		if (srcAddr.IP.To4() == nil) != (dstAddr.IP.To4() == nil) {
+			srcAddr.IP = srcAddr.IP.To16()
+			dstAddr.IP = dstAddr.IP.To16()
+		} else if srcAddr.IP.To4() != nil {
+			srcAddr.IP = srcAddr.IP.To4()
+			dstAddr.IP = dstAddr.IP.To4()
+		}
+	}
+
+	switch version {
+	case ProxyProtocolV1:
+		return proxyProtocolV1(srcAddr, dstAddr), nil
+	case ProxyProtocolV2:
+		return proxyProtocolV2(srcAddr, dstAddr), nil
+	}
+	return nil, fmt.Errorf("unsupported proxy protocol version [%s]", version)
+}
+
+//地址为空或者没有IP时返回nil
+func resolveProxyAddr(addr string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil || a.IP == nil {
+		return nil
+	}
+	return a
+}
+
+func proxyProtocolV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if len(src.IP) == net.IPv4len {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(src.IP), ipv6String(dst.IP), src.Port, dst.Port))
+}
+
+//net.IP.String()把IPv4映射地址输出为点分格式，TCP6要求IPv6格式
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func proxyProtocolV2(src, dst *net.TCPAddr) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(proxyProtocolV2Sig)
+	if src == nil || dst == nil {
+		//版本2，LOCAL命令，不携带地址
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	//版本2，PROXY命令；0x11为TCP over IPv4，0x21为TCP over IPv6
+	buf.WriteByte(0x21)
+	if len(src.IP) == net.IPv4len {
+		buf.WriteByte(0x11)
+	} else {
+		buf.WriteByte(0x21)
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(src.IP)*2+4))
+	buf.Write(src.IP)
+	buf.Write(dst.IP)
+	binary.Write(buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProxyProtocolV1(t *testing.T) {
+	cases := []struct {
+		src, dst string
+		want     string
+	}{
+		{"1.2.3.4:1000", "5.6.7.8:80", "PROXY TCP4 1.2.3.4 5.6.7.8 1000 80\r\n"},
+		{"[2001:db8::1]:1000", "[2001:db8::2]:80", "PROXY TCP6 2001:db8::1 2001:db8::2 1000 80\r\n"},
+		//IPv4映射地址按IPv4处理
+		{"[::ffff:1.2.3.4]:1000", "5.6.7.8:80", "PROXY TCP4 1.2.3.4 5.6.7.8 1000 80\r\n"},
+		//地址族不同时IPv4地址以IPv6格式输出
+		{"1.2.3.4:1000", "[2001:db8::2]:80", "PROXY TCP6 ::ffff:1.2.3.4 2001:db8::2 1000 80\r\n"},
+		{"[2001:db8::1]:1000", "5.6.7.8:80", "PROXY TCP6 2001:db8::1 ::ffff:5.6.7.8 1000 80\r\n"},
+		{"", "5.6.7.8:80", "PROXY UNKNOWN\r\n"},
+	}
+	for _, c := range cases {
+		header, err := ProxyProtocolHeader(ProxyProtocolV1, c.src, c.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(header) != c.want {
+			t.Errorf("%s -> %s: header = %q, want %q", c.src, c.dst, header, c.want)
+		}
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	header, err := ProxyProtocolHeader(ProxyProtocolV2, "1.2.3.4:1000", "[2001:db8::2]:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(header, proxyProtocolV2Sig) {
+		t.Fatal("missing signature")
+	}
+	rest := header[len(proxyProtocolV2Sig):]
+	if rest[0] != 0x21 || rest[1] != 0x21 || int(rest[2])<<8|int(rest[3]) != 36 || len(rest) != 4+36 {
+		t.Fatalf("bad IPv6 header % x", rest)
+	}
+	//IPv4映射地址
+	if !bytes.Equal(rest[4:20], append(bytes.Repeat([]byte{0}, 10), 0xff, 0xff, 1, 2, 3, 4)) {
+		t.Fatalf("bad source address % x", rest[4:20])
+	}
+
+	header, _ = ProxyProtocolHeader(ProxyProtocolV2, "bad", "5.6.7.8:80")
+	if !bytes.Equal(header[len(proxyProtocolV2Sig):], []byte{0x20, 0x00, 0x00, 0x00}) {
+		t.Fatalf("bad LOCAL header % x", header)
+	}
+
+	if _, err := ProxyProtocolHeader("v3", "1.2.3.4:1000", "5.6.7.8:80"); err == nil {
+		t.Fatal("unsupported version is accepted")
+	}
+}